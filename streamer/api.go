@@ -247,10 +247,23 @@ func StatusMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// isOperationalPath reports whether an API path controls the streamer without modifying its configuration.
+func isOperationalPath(path string) bool {
+	if strings.HasPrefix(path, "/api/dlq") {
+		return true
+	}
+	if strings.HasPrefix(path, "/api/map/") && strings.HasSuffix(path, "/resync") {
+		return true
+	}
+	return strings.HasPrefix(path, "/api/url/") &&
+		(strings.HasSuffix(path, "/restart") || strings.HasSuffix(path, "/pause") || strings.HasSuffix(path, "/resume"))
+}
+
 func DeclarativeModeMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if config.App.MapDatabase == "" &&
 			strings.HasPrefix(r.URL.Path, "/api") &&
+			!isOperationalPath(r.URL.Path) &&
 			r.Method != http.MethodGet &&
 			r.Method != http.MethodOptions {
 			req := PrepareReq(w, r)
@@ -320,6 +333,8 @@ func APIServer(log *slog.Logger) {
 	router.HandleFunc("/api/map/{id}", mapGetOneHandler).Methods("GET")
 	router.HandleFunc("/api/map/{id}/create", mapCreateTableHandler).Methods("POST")
 	router.HandleFunc("/api/map/{id}/clone", mapCloneTableHandler).Methods("POST")
+	router.HandleFunc("/api/map/{id}/resync", mapResyncHandler).Methods("POST")
+	router.HandleFunc("/api/map/{id}/resync", mapGetResyncHandler).Methods("GET")
 	router.HandleFunc("/api/map/refresh", mapRefreshHandler).Methods("POST")
 
 	router.HandleFunc("/api/db/{id}", dbGetOneHandler).Methods("GET")
@@ -334,6 +349,10 @@ func APIServer(log *slog.Logger) {
 	router.HandleFunc("/api/url/{id}", urlDeleteOneHandler).Methods("DELETE")
 	router.HandleFunc("/api/url/{id}", urlPutOneHandler).Methods("PUT")
 	router.HandleFunc("/api/url/restart", urlPostRestartAllHandler).Methods("POST")
+	router.HandleFunc("/api/url/{id}/status", urlGetStatusHandler).Methods("GET")
+	router.HandleFunc("/api/url/{id}/restart", urlPostCommandHandler(URLCommandRestart)).Methods("POST")
+	router.HandleFunc("/api/url/{id}/pause", urlPostCommandHandler(URLCommandPause)).Methods("POST")
+	router.HandleFunc("/api/url/{id}/resume", urlPostCommandHandler(URLCommandResume)).Methods("POST")
 
 	router.HandleFunc("/api/tbl/{id}", tblGetOneHandler).Methods("GET")
 	router.HandleFunc("/api/tbl", tblGetManyHandler).Methods("GET")
@@ -341,6 +360,11 @@ func APIServer(log *slog.Logger) {
 	router.HandleFunc("/api/tbl/{id}", tblDeleteOneHandler).Methods("DELETE")
 	router.HandleFunc("/api/tbl/{id}", tblPutOneHandler).Methods("PUT")
 
+	router.HandleFunc("/api/dlq/{id}", dlqGetOneHandler).Methods("GET")
+	router.HandleFunc("/api/dlq", dlqGetManyHandler).Methods("GET")
+	router.HandleFunc("/api/dlq/{id}/retry", dlqRetryHandler).Methods("POST")
+	router.HandleFunc("/api/dlq/{id}", dlqDeleteOneHandler).Methods("DELETE")
+
 	// Start the engine
 	log.Debug("Starting api server", "config", config.Server)
 	srv := &http.Server{
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// copyTable is the temporary table receiving runs of inserts copied into a destination table.
+const copyTable = "kvsz_copy"
+
+// cloneActions are the metric actions of the batched operations.
+var cloneActions = map[string]string{"ic": "insert", "uc": "update", "dc": "delete"}
+
+// batchable reports whether an operation can be sent in a batch of statements.
+func batchable(op operation) bool {
+	return op.opCode == "ic" || op.opCode == "uc" || op.opCode == "dc"
+}
+
+// flush applies the buffered operations. In transactional apply mode, each source transaction is applied atomically.
+// It returns an error when an operation could be neither applied nor moved to the dead letter table,
+// the destination transaction is then rolled back and the sources restarted.
+func (w *Worker) flush() error {
+	pending := w.pending
+	w.pending = nil
+	var err error
+	if config.App.ApplyMode == ApplyModeTransactional {
+		for i := range pending {
+			if err = w.applyTransaction(pending[i], pending[i+1:]); err != nil {
+				break
+			}
+		}
+	} else {
+		err = w.applyOperations(pending, nil)
+	}
+	if err != nil {
+		w.abort(err)
+	}
+	return err
+}
+
+// applyOperations applies operations in order. Consecutive clone operations are sent together:
+// runs of inserts into the same table are copied, the other operations are pipelined.
+// In batch apply mode, consecutive clone operations are grouped by table, keeping the order
+// of the operations of each table but not the order between tables.
+// Other operations are applied one by one, in order, and DDL statements are committed when applied.
+// The following operations are not applied yet, their positions must not be committed with a DDL statement.
+func (w *Worker) applyOperations(ops []operation, following []operation) error {
+	for i := 0; i < len(ops); {
+		if ops[i].opCode == "ddl" {
+			if err := w.applyDDL(ops[i], append(slices.Clone(ops[i+1:]), following...)); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		if !batchable(ops[i]) {
+			if err := w.apply(ops[i]); err != nil {
+				return err
+			}
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(ops) && batchable(ops[j]) {
+			j++
+		}
+		run := ops[i:j]
+		if config.App.ApplyMode == ApplyModeBatch {
+			sort.SliceStable(run, func(a, b int) bool { return run[a].destTable < run[b].destTable })
+		}
+		if err := w.applyRun(run); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// applyTransaction applies a complete source transaction in a savepoint of the destination transaction.
+// DDL statements are committed when applied, so they split the source transaction in parts applied atomically.
+func (w *Worker) applyTransaction(tx operation, following []operation) error {
+	ops := tx.batch
+	if tx.opCode != "tx" {
+		ops = []operation{tx}
+	}
+	for {
+		i := slices.IndexFunc(ops, func(op operation) bool { return op.opCode == "ddl" })
+		if i < 0 {
+			return w.applyAtomically(ops)
+		}
+		if err := w.applyAtomically(ops[:i]); err != nil {
+			return err
+		}
+		if err := w.applyDDL(ops[i], append(slices.Clone(ops[i+1:]), following...)); err != nil {
+			return err
+		}
+		ops = ops[i+1:]
+	}
+}
+
+// applyAtomically applies the operations of a source transaction in a savepoint. When one of them fails,
+// the savepoint is rolled back and all the operations are moved to the dead letter table, so that
+// the source transaction is never partially visible in the destination.
+func (w *Worker) applyAtomically(ops []operation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	savepoint, err := w.tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot create transaction savepoint, error=%w", err)
+	}
+	tx := w.tx
+	w.tx, w.atomic, w.failed = savepoint, true, nil
+	err = w.applyOperations(ops, nil)
+	failed := w.failed
+	w.tx, w.atomic, w.failed = tx, false, nil
+	if err != nil {
+		return err
+	}
+	if failed == nil {
+		if err = savepoint.Commit(ctx); err != nil {
+			return fmt.Errorf("cannot release transaction savepoint, error=%w", err)
+		}
+		return nil
+	}
+	if err = savepoint.Rollback(ctx); err != nil {
+		return fmt.Errorf("cannot rollback transaction savepoint, error=%w", err)
+	}
+	w.log.Warn("Source transaction rolled back", "lsn", ops[0].lsn, "operations", len(ops), "error", failed)
+	failed = fmt.Errorf("source transaction rolled back, error=%w", failed)
+	for _, op := range ops {
+		if err = op.deadLetter(w.tx, failed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyKey identifies the inserts that can be copied together.
+func copyKey(op operation) string {
+	if op.opCode != "ic" {
+		return ""
+	}
+	return fmt.Sprintf("%s(%t,%s)", op.destTable, op.destTableHasSID, strings.Join(op.insertColumns(), ","))
+}
+
+// applyRun splits clone operations in runs of inserts large enough to be copied and batches of statements.
+func (w *Worker) applyRun(ops []operation) error {
+	start := 0
+	for i := 0; i < len(ops); {
+		key := copyKey(ops[i])
+		j := i + 1
+		for key != "" && j < len(ops) && copyKey(ops[j]) == key {
+			j++
+		}
+		if key == "" || config.App.CopyThreshold == 0 || j-i < config.App.CopyThreshold {
+			i = j
+			continue
+		}
+		if err := w.applyStatements(ops[start:i]); err != nil {
+			return err
+		}
+		if err := w.applyCopy(ops[i:j]); err != nil {
+			return err
+		}
+		start, i = j, j
+	}
+	return w.applyStatements(ops[start:])
+}
+
+// applyOneByOne applies operations in their own savepoints, after a batch failed.
+func (w *Worker) applyOneByOne(ops []operation, err error) error {
+	w.log.Warn("Batch failed, applying operations one by one", "operations", len(ops), "error", err)
+	for i := range ops {
+		if err := w.apply(ops[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyStatements sends the statements of clone operations in a single round trip.
+// The batch runs in a savepoint, if any statement fails the operations are applied one by one
+// so that only the failing ones are moved to the dead letter table.
+func (w *Worker) applyStatements(ops []operation) error {
+	if len(ops) == 0 {
+		return nil
+	}
+	if len(ops) == 1 {
+		return w.apply(ops[0])
+	}
+	ctx := context.Background()
+	t0 := time.Now()
+	batch := &pgx.Batch{}
+	savepoint, err := w.tx.Begin(ctx)
+	if err != nil {
+		return w.applyOneByOne(ops, fmt.Errorf("cannot create savepoint, error=%w", err))
+	}
+	for _, op := range ops {
+		var q cloneQuery
+		switch op.opCode {
+		case "ic":
+			q = op.insertCloneQuery()
+		case "uc":
+			q, err = op.updateCloneQuery()
+		case "dc":
+			q = op.deleteCloneQuery()
+		}
+		var name string
+		if err == nil {
+			name, err = prepareStatement(ctx, savepoint, q)
+		}
+		if err != nil {
+			_ = savepoint.Rollback(ctx)
+			return w.applyOneByOne(ops, err)
+		}
+		batch.Queue(name, q.parameters...)
+	}
+	results := savepoint.SendBatch(ctx, batch)
+	for _, op := range ops {
+		tag, err := results.Exec()
+		if err != nil {
+			_ = results.Close()
+			_ = savepoint.Rollback(ctx)
+			return w.applyOneByOne(ops, err)
+		}
+		if op.opCode == "dc" && tag.RowsAffected() == 0 {
+			op.log.Error("did not find row to delete, destination database was not in sync", "table", op.destTable)
+			requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
+		}
+	}
+	if err = results.Close(); err != nil {
+		_ = savepoint.Rollback(ctx)
+		return w.applyOneByOne(ops, err)
+	}
+	if err = savepoint.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot release savepoint, error=%w", err)
+	}
+	trimStatements(ctx, w.tx.Conn())
+	for _, op := range ops {
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, cloneActions[op.opCode], "success").Inc()
+	}
+	requestDuration.WithLabelValues(ops[0].database, ops[0].sid, ops[0].sourceTable, "batch", "success").Observe(time.Since(t0).Seconds())
+	w.log.Debug("Applied batch", "operations", len(ops))
+	return nil
+}
+
+// applyCopy copies a run of inserts into a temporary table then inserts them in the destination table,
+// skipping the rows already present as a single insert does.
+// The run is applied in a savepoint, if it fails the inserts are applied one by one.
+func (w *Worker) applyCopy(ops []operation) error {
+	ctx := context.Background()
+	t0 := time.Now()
+	first := ops[0]
+	columns := first.insertColumns()
+	if first.destTableHasSID {
+		columns = append([]string{"sid"}, columns...)
+	}
+	rows := make([][]any, 0, len(ops))
+	for _, op := range ops {
+		row := make([]any, 0, len(columns))
+		for _, c := range columns {
+			if c == "sid" && op.destTableHasSID {
+				row = append(row, op.sid)
+				continue
+			}
+			row = append(row, op.values[c])
+		}
+		rows = append(rows, row)
+	}
+	savepoint, err := w.tx.Begin(ctx)
+	if err != nil {
+		return w.applyOneByOne(ops, fmt.Errorf("cannot create savepoint, error=%w", err))
+	}
+	err = copyInserts(ctx, savepoint, first.destTable, columns, rows)
+	if err != nil {
+		_ = savepoint.Rollback(ctx)
+		return w.applyOneByOne(ops, err)
+	}
+	if err = savepoint.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot release savepoint, error=%w", err)
+	}
+	requestsTotal.WithLabelValues(first.database, first.sid, first.sourceTable, "insert", "success").Add(float64(len(ops)))
+	requestDuration.WithLabelValues(first.database, first.sid, first.sourceTable, "copy", "success").Observe(time.Since(t0).Seconds())
+	w.log.Debug("Copied inserts", "table", first.destTable, "rows", len(ops))
+	return nil
+}
+
+// copyInserts copies rows into a temporary table with the copied columns only, so that the defaults
+// and constraints of the other destination columns apply when the rows are inserted.
+func copyInserts(ctx context.Context, tx pgx.Tx, destTable string, columns []string, rows [][]any) error {
+	list := strings.Join(columns, ", ")
+	_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", copyTable, list, destTable))
+	if err != nil {
+		return fmt.Errorf("cannot create copy table, table=%s, error=%w", destTable, err)
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{copyTable}, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("cannot copy inserts, table=%s, error=%w", destTable, err)
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT DO NOTHING", destTable, list, list, copyTable))
+	if err != nil {
+		return fmt.Errorf("cannot insert copied rows, table=%s, error=%w", destTable, err)
+	}
+	_, err = tx.Exec(ctx, "DROP TABLE "+copyTable)
+	if err != nil {
+		return fmt.Errorf("cannot drop copy table, table=%s, error=%w", destTable, err)
+	}
+	return nil
+}
@@ -9,36 +9,140 @@ import (
 	"github.com/google/cel-go/common/types"
 	"github.com/google/cel-go/common/types/ref"
 	"github.com/google/cel-go/ext"
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
-func ConvertPGColumnsToEnv(c map[string]PGColumn) map[string]any {
-	env := make(map[string]any)
+// celMetadata declares the change metadata available to expressions in addition to the columns.
+var celMetadata = map[string]*cel.Type{
+	"op":           cel.StringType,
+	"old":          cel.MapType(cel.StringType, cel.DynType),
+	"sid":          cel.StringType,
+	"database":     cel.StringType,
+	"source_table": cel.StringType,
+	"lsn":          cel.StringType,
+	"commit_time":  cel.TimestampType,
+}
 
-	for key, column := range c {
-		var goVal any // Will be nil for NULL values by default
-
-		// Use a type switch to handle different pgtype implementations from pgx/v5
-		switch column.ColumnType {
-		case "text":
-			goVal = string("")
-		case "int2":
-			goVal = int32(0)
-		case "int4":
-			goVal = int64(0)
-		case "int8":
-			goVal = int8(0)
-		case "uuid":
-			goVal = string("")
-		case "float8":
-			goVal = float64(0)
-		case "bytea":
-			goVal = []byte{}
-		case "timestamptz":
-			goVal = time.Time{}
+// celTypeMap resolves the types of source columns when expressions are compiled.
+var celTypeMap = pgtype.NewMap()
+
+// celType returns the CEL type of a Postgres type.
+// Types without a CEL equivalent are strings holding their text representation.
+func celType(m *pgtype.Map, oid uint32) *cel.Type {
+	switch oid {
+	case pgtype.BoolOID:
+		return cel.BoolType
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+		return cel.IntType
+	case pgtype.Float4OID, pgtype.Float8OID, pgtype.NumericOID:
+		return cel.DoubleType
+	case pgtype.DateOID, pgtype.TimestampOID, pgtype.TimestamptzOID:
+		return cel.TimestampType
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		return cel.DynType
+	case pgtype.ByteaOID:
+		return cel.BytesType
+	}
+	if elementOID, ok := arrayElementOID(m, oid); ok {
+		return cel.ListType(celType(m, elementOID))
+	}
+	return cel.StringType
+}
+
+// arrayElementOID returns the type of the elements of an array type.
+func arrayElementOID(m *pgtype.Map, oid uint32) (uint32, bool) {
+	t, ok := m.TypeForOID(oid)
+	if !ok {
+		return 0, false
+	}
+	codec, ok := t.Codec.(*pgtype.ArrayCodec)
+	if !ok {
+		return 0, false
+	}
+	return codec.ElementType.OID, true
+}
+
+// celValue decodes a column received in text format into the value of its CEL type.
+func celValue(m *pgtype.Map, oid uint32, data []byte) (any, error) {
+	t := celType(m, oid)
+	if t == cel.StringType {
+		return string(data), nil
+	}
+	dt, ok := m.TypeForOID(oid)
+	if !ok {
+		return string(data), nil
+	}
+	value, err := dt.Codec.DecodeValue(m, oid, pgtype.TextFormatCode, data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode column data %s, error: %w", data, err)
+	}
+	return convertCELValue(m, oid, value), nil
+}
+
+// convertCELValue converts a value decoded by pgx to the Go type matching its CEL type.
+// Values that cannot be converted, like infinite timestamps, are NULL.
+func convertCELValue(m *pgtype.Map, oid uint32, value any) any {
+	if value == nil {
+		return nil
+	}
+	switch t := celType(m, oid); {
+	case t == cel.IntType:
+		switch v := value.(type) {
+		case int16:
+			return int64(v)
+		case int32:
+			return int64(v)
+		case int64:
+			return v
+		case uint32:
+			return int64(v)
+		}
+	case t == cel.DoubleType:
+		switch v := value.(type) {
+		case float32:
+			return float64(v)
+		case float64:
+			return v
+		case pgtype.Numeric:
+			f, err := v.Float64Value()
+			if err == nil && f.Valid {
+				return f.Float64
+			}
+		}
+	case t == cel.TimestampType:
+		if v, ok := value.(time.Time); ok {
+			return v
+		}
+	case t == cel.StringType:
+		switch v := value.(type) {
+		case string:
+			return v
+		case [16]byte: // uuid
+			return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16])
 		default:
-			goVal = string("")
+			return fmt.Sprint(v)
 		}
-		env[key] = goVal
+	case t.Kind() == types.ListKind:
+		elementOID, _ := arrayElementOID(m, oid)
+		if v, ok := value.([]any); ok {
+			list := make([]any, len(v))
+			for i := range v {
+				list[i] = convertCELValue(m, elementOID, v[i])
+			}
+			return list
+		}
+	default:
+		return value
+	}
+	log.Debug("Cannot convert value to CEL type", "oid", oid, "value", value, "type", reflect.TypeOf(value))
+	return nil
+}
+
+// ConvertPGColumnsToEnv declares the CEL types of the columns of a source table.
+func ConvertPGColumnsToEnv(c map[string]PGColumn) map[string]*cel.Type {
+	env := make(map[string]*cel.Type)
+	for key, column := range c {
+		env[key] = celType(celTypeMap, column.DataTypeOID)
 	}
 	log.Debug("Converted pgcolumns to env", "PGColumns", c, "env", env)
 	return env
@@ -64,7 +168,7 @@ func bytesOrError(s []byte, err error) ref.Val {
 	return types.Bytes(s)
 }
 
-func prepareExpression(expression string, variables map[string]any) (cel.Program, error) { //nolint:ireturn // we have no choice here
+func prepareExpression(expression string, variables map[string]*cel.Type) (cel.Program, error) { //nolint:ireturn // we have no choice here
 	envOpts := []cel.EnvOption{
 		cel.OptionalTypes(),
 		cel.HomogeneousAggregateLiterals(),
@@ -90,41 +194,15 @@ func prepareExpression(expression string, variables map[string]any) (cel.Program
 
 	envOpts = append(envOpts, cel.Variable("now", cel.TimestampType))
 
-	for key, value := range variables {
-		// Infer the CEL type from the Go type of the value.
-		// cel-go's common.Types provides helpers for common Go types.
-		var celType *cel.Type
-		switch value.(type) {
-		case nil:
-			celType = cel.NullType
-		case int, int32, int64:
-			celType = cel.IntType
-		case float32, float64:
-			celType = cel.DoubleType
-		case string:
-			celType = cel.StringType
-		case bool:
-			celType = cel.BoolType
-		case time.Time:
-			celType = cel.TimestampType
-		case map[string]any:
-			// For maps, we can declare it as a dynamic type (cel.DynType)
-			// or define a more specific map type if the structure is known.
-			celType = cel.DynType // Or cel.MapType(cel.StringType, cel.DynType) for string keys
-		case []any:
-			// For slices, declare as a dynamic list type.
-			celType = cel.ListType(cel.DynType) // Or cel.ListType(cel.DynType)
-		case []uint8:
-			// For slices, declare as a dynamic list type.
-			celType = cel.BytesType // Or cel.ListType(cel.DynType)
-		default:
-			celType = cel.DynType
-			log.Debug("Warning: Could not infer specific CEL type, using cel.DynType", "key", key, "type", reflect.TypeOf(value))
-		}
+	for key, t := range variables {
 		if key == "type" {
 			key = "_type"
 		}
-		envOpts = append(envOpts, cel.Variable(key, celType))
+		envOpts = append(envOpts, cel.Variable(key, t))
+	}
+	// entries with source columns named as metadata variables are rejected
+	for key, t := range celMetadata {
+		envOpts = append(envOpts, cel.Variable(key, t))
 	}
 	env, err := cel.NewEnv(envOpts...)
 	if err != nil {
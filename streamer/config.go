@@ -27,8 +27,9 @@ type (
 	}
 
 	MaintenanceConfig struct {
-		Pprof      string `koanf:"pprof"`
-		StartDelay int    `koanf:"start_delay"`
+		Pprof             string `koanf:"pprof"`
+		StartDelay        int    `koanf:"start_delay"`
+		SlotCheckInterval int    `koanf:"slot_check_interval"`
 	}
 	DatabaseConfig struct {
 		URL    string `koanf:"url"`
@@ -40,13 +41,22 @@ type (
 		JWTKey string `koanf:"jwt_key"`
 	}
 	AppConfig struct {
-		MapFile       string     `koanf:"map_file"`
-		MapDatabase   string     `koanf:"map_database"`
-		NumWorkers    int        `koanf:"num_workers"`
-		CommitDelay   float64    `koanf:"commit_delay"`
-		DefaultSchema string     `koanf:"default_schema"`
-		SyncRate      rate.Limit `koanf:"sync_rate"`
-		SyncBurst     int        `koanf:"sync_burst"`
+		MapFile          string     `koanf:"map_file"`
+		MapDatabase      string     `koanf:"map_database"`
+		NumWorkers       int        `koanf:"num_workers"`
+		CommitDelay      float64    `koanf:"commit_delay"`
+		ApplyMode        string     `koanf:"apply_mode"`
+		ApplyBatchSize   int        `koanf:"apply_batch_size"`
+		CopyThreshold    int        `koanf:"copy_threshold"`
+		DefaultSchema    string     `koanf:"default_schema"`
+		SyncRate         rate.Limit `koanf:"sync_rate"`
+		SyncBurst        int        `koanf:"sync_burst"`
+		SyncParallelism  int        `koanf:"sync_parallelism"`
+		SyncChunks       int        `koanf:"sync_chunks"`
+		StreamBufferSize int        `koanf:"stream_buffer_size"`
+		SpillDirectory   string     `koanf:"spill_directory"`
+		DDLReplication   bool       `koanf:"ddl_replication"`
+		CommandPrefix    string     `koanf:"command_prefix"`
 	}
 
 	CORSConfig struct {
@@ -79,8 +89,9 @@ var config = Config{
 		MaxHeaderBytes:    1000,
 	},
 	Maintenance: MaintenanceConfig{
-		Pprof:      "",
-		StartDelay: 0,
+		Pprof:             "",
+		StartDelay:        0,
+		SlotCheckInterval: 30,
 	},
 	Logs: defaultLogsConfig,
 	Database: DatabaseConfig{
@@ -89,13 +100,22 @@ var config = Config{
 		Schema: "public",
 	},
 	App: AppConfig{
-		MapFile:       "/etc/kuvasz/map.yaml",
-		MapDatabase:   "",
-		NumWorkers:    2,
-		CommitDelay:   1.0,
-		DefaultSchema: "public",
-		SyncRate:      1_000_000_000,
-		SyncBurst:     1_000,
+		MapFile:          "/etc/kuvasz/map.yaml",
+		MapDatabase:      "",
+		NumWorkers:       2,
+		CommitDelay:      1.0,
+		ApplyMode:        ApplyModeBatch,
+		ApplyBatchSize:   1000,
+		CopyThreshold:    100,
+		DefaultSchema:    "public",
+		SyncRate:         1_000_000_000,
+		SyncBurst:        1_000,
+		SyncParallelism:  1,
+		SyncChunks:       1,
+		StreamBufferSize: 64 * 1024 * 1024,
+		SpillDirectory:   "",
+		DDLReplication:   false,
+		CommandPrefix:    "",
 	},
 	Cors: CORSConfig{
 		AllowedOrigins:   []string{"*"},
@@ -143,6 +163,10 @@ func reloadConfig(configFiles []string, f *flag.FlagSet, envPrefix string) {
 	if err != nil {
 		log.Error("can't unmarshal config", "error", err)
 	}
+	if config.App.ApplyMode != ApplyModeBatch && config.App.ApplyMode != ApplyModeTransactional {
+		log.Error("invalid apply mode", "apply_mode", config.App.ApplyMode)
+		os.Exit(1)
+	}
 }
 
 func Configure(configFiles []string, envPrefix string) {
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+)
+
+// ddlMessagePrefix is the prefix of the logical decoding messages emitted by the DDL event trigger.
+const ddlMessagePrefix = "kuvasz_ddl"
+
+// ddlTriggerFunction emits a logical decoding message for each table altered by a statement.
+// The message is transactional so that it is decoded in stream order with the changes of the transaction.
+const ddlTriggerFunction = `CREATE OR REPLACE FUNCTION kuvasz_emit_ddl() RETURNS event_trigger LANGUAGE plpgsql AS $$
+DECLARE
+	r record;
+BEGIN
+	FOR r IN SELECT DISTINCT c.schema_name, t.relname
+		FROM pg_event_trigger_ddl_commands() c
+		INNER JOIN pg_class t ON t.oid = c.objid
+		WHERE c.object_type IN ('table', 'table column') LOOP
+		PERFORM pg_logical_emit_message(true, 'kuvasz_ddl', json_build_object(
+			'schema', r.schema_name,
+			'table', r.relname,
+			'query', current_query())::text);
+	END LOOP;
+END
+$$`
+
+type ddlMessage struct {
+	Schema string `json:"schema"`
+	Table  string `json:"table"`
+	Query  string `json:"query"`
+}
+
+var (
+	ddlAlterTable   = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(?:IF\s+EXISTS\s+)?(?:ONLY\s+)?(\S+)\s+(.+)$`)
+	ddlAddKey       = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT\s+\S+\s+)?PRIMARY\s+KEY\s*\((.+)\)$`)
+	ddlAddOther     = regexp.MustCompile(`(?is)^ADD\s+(?:CONSTRAINT|UNIQUE|CHECK|FOREIGN|EXCLUDE)\b`)
+	ddlAddColumn    = regexp.MustCompile(`(?is)^ADD\s+(?:COLUMN\s+)?(?:IF\s+NOT\s+EXISTS\s+)?(\S+)\s+(.+)$`)
+	ddlAlterType    = regexp.MustCompile(`(?is)^ALTER\s+(?:COLUMN\s+)?(\S+)\s+(?:SET\s+DATA\s+)?TYPE\s+(.+)$`)
+	ddlRenameColumn = regexp.MustCompile(`(?is)^RENAME\s+(?:COLUMN\s+)?(\S+)\s+TO\s+(\S+)$`)
+	ddlRenameTable  = regexp.MustCompile(`(?is)^RENAME\s+TO\b`)
+	// modifiers of a type, for example the length of varchar(20)
+	ddlTypeModifiers = regexp.MustCompile(`\(\s*(\d+(?:\s*,\s*\d+)*)\s*\)`)
+	// clauses following the type of a column
+	ddlTypeEnd = regexp.MustCompile(`(?is)\s(?:NOT\s+NULL|NULL|DEFAULT|CONSTRAINT|PRIMARY|UNIQUE|CHECK|REFERENCES|GENERATED|COLLATE|USING)\b`)
+)
+
+// installDDLTrigger creates the event trigger emitting the DDL of the source in the replication stream.
+func installDDLTrigger(ctx context.Context, log *slog.Logger, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, ddlTriggerFunction)
+	if err != nil {
+		return fmt.Errorf("cannot create ddl trigger function, error=%w", err)
+	}
+	var count int
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM pg_event_trigger WHERE evtname = 'kuvasz_ddl'").Scan(&count)
+	if err != nil {
+		return fmt.Errorf("cannot check ddl trigger, error=%w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	log.Info("Creating DDL event trigger")
+	_, err = conn.Exec(ctx, "CREATE EVENT TRIGGER kuvasz_ddl ON ddl_command_end WHEN TAG IN ('ALTER TABLE') EXECUTE FUNCTION kuvasz_emit_ddl()")
+	if err != nil {
+		return fmt.Errorf("cannot create ddl trigger, error=%w", err)
+	}
+	return nil
+}
+
+// splitTopLevel splits a statement on a separator outside of parentheses and quotes.
+func splitTopLevel(s string, separator rune) []string {
+	var result []string
+	depth := 0
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == separator && depth == 0:
+			result = append(result, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(result, strings.TrimSpace(s[start:]))
+}
+
+// unquote returns an identifier as stored in the catalog.
+func unquote(identifier string) string {
+	if strings.HasPrefix(identifier, `"`) {
+		return strings.ReplaceAll(strings.Trim(identifier, `"`), `""`, `"`)
+	}
+	return strings.ToLower(identifier)
+}
+
+// alterTableActions returns the actions of the ALTER TABLE statements of a query modifying a table.
+func alterTableActions(query string, schema string, table string) []string {
+	var actions []string
+	for _, statement := range splitTopLevel(query, ';') {
+		m := ddlAlterTable.FindStringSubmatch(statement)
+		if m == nil {
+			continue
+		}
+		name := m[1]
+		if s, t, found := strings.Cut(name, "."); found {
+			if unquote(s) != schema {
+				continue
+			}
+			name = t
+		}
+		if unquote(name) != table {
+			continue
+		}
+		actions = append(actions, splitTopLevel(m[2], ',')...)
+	}
+	return actions
+}
+
+// translateDDL translates the ALTER TABLE actions of a source table in statements for a destination table,
+// one per action as a column rename cannot be combined with other actions.
+// Columns are renamed and excluded as configured and the sid column is added to primary keys.
+// Column names are quoted, so they keep the case they have in the source catalog.
+// Actions that cannot be applied to the destination are skipped, the result is empty when none is left.
+func translateDDL(log *slog.Logger, entry MappingEntry, destTable string, actions []string, keys bool) []string {
+	column := func(name string) (string, bool) {
+		name = unquote(name)
+		if slices.Contains(entry.Exclude, name) {
+			return "", false
+		}
+		if d, ok := entry.Columns[name]; ok {
+			return d, true
+		}
+		return name, true
+	}
+	_, hasSID := DestTables()[destTable].Columns["sid"]
+	translated := make([]string, 0, len(actions))
+	for _, action := range actions {
+		if m := ddlAddKey.FindStringSubmatch(action); m != nil {
+			if !keys {
+				continue
+			}
+			columns := make([]string, 0)
+			if hasSID {
+				columns = append(columns, pgx.Identifier{"sid"}.Sanitize())
+			}
+			for _, c := range splitTopLevel(m[1], ',') {
+				if name, ok := column(c); ok {
+					columns = append(columns, pgx.Identifier{name}.Sanitize())
+				}
+			}
+			translated = append(translated, fmt.Sprintf("ADD PRIMARY KEY (%s)", strings.Join(columns, ", ")))
+			continue
+		}
+		if ddlAddOther.MatchString(action) || ddlRenameTable.MatchString(action) {
+			log.Warn("Skipping unsupported DDL", "table", destTable, "action", action)
+			continue
+		}
+		if m := ddlAddColumn.FindStringSubmatch(action); m != nil {
+			if name, ok := column(m[1]); ok {
+				translated = append(translated, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", pgx.Identifier{name}.Sanitize(), columnType(m[2])))
+			}
+			continue
+		}
+		if m := ddlAlterType.FindStringSubmatch(action); m != nil {
+			if name, ok := column(m[1]); ok {
+				translated = append(translated, fmt.Sprintf("ALTER COLUMN %s TYPE %s", pgx.Identifier{name}.Sanitize(), columnType(m[2])))
+			}
+			continue
+		}
+		if m := ddlRenameColumn.FindStringSubmatch(action); m != nil {
+			from, to := unquote(m[1]), unquote(m[2])
+			if _, ok := entry.Columns[from]; ok || slices.Contains(entry.Exclude, from) {
+				log.Warn("Skipping rename of mapped column, update the mapping", "table", destTable, "column", from)
+				continue
+			}
+			translated = append(translated, fmt.Sprintf("RENAME COLUMN %s TO %s", pgx.Identifier{from}.Sanitize(), pgx.Identifier{to}.Sanitize()))
+			continue
+		}
+		log.Warn("Skipping unsupported DDL", "table", destTable, "action", action)
+	}
+	for i := range translated {
+		translated[i] = fmt.Sprintf("ALTER TABLE %s %s", destTable, translated[i])
+	}
+	return translated
+}
+
+// columnType returns the type of a column definition without its constraints, default and collation.
+func columnType(definition string) string {
+	if loc := ddlTypeEnd.FindStringIndex(definition); loc != nil {
+		definition = definition[:loc[0]]
+	}
+	return strings.TrimSpace(definition)
+}
+
+// replicateDDL translates a DDL message of the source for each destination of the altered table
+// and dispatches it to be applied in stream order.
+// Destinations computed by set or target expressions and events tables are not altered.
+func replicateDDL(log *slog.Logger, op operation, content []byte, state *replicationState) {
+	var message ddlMessage
+	if err := json.Unmarshal(content, &message); err != nil {
+		log.Error("Cannot decode DDL message", "content", string(content), "error", err)
+		return
+	}
+	entries, err := MappingTable().FindAllByName(op.database, joinSchema(message.Schema, message.Table))
+	if err != nil {
+		log.Debug("Ignoring DDL of unconfigured table", "schema", message.Schema, "table", message.Table)
+		return
+	}
+	actions := alterTableActions(message.Query, message.Schema, message.Table)
+	rel := PGRelation{Namespace: message.Schema, RelationName: message.Table}
+	for _, entry := range entries {
+		if !entry.Replicated || entry.Type == TableTypeEvents || entry.compiledTarget != nil || len(entry.compiledSet) > 0 {
+			continue
+		}
+		destTable := entry.destTable()
+		tables := map[string]bool{destTable: entry.Type == TableTypeClone || entry.Type == TableTypeSoftDelete || entry.Type == TableTypeHistory4}
+		if entry.Type == TableTypeHistory4 {
+			tables[historyTableName(destTable)] = false
+		}
+		for table, keys := range tables {
+			for _, statement := range translateDDL(log, entry, table, actions, keys) {
+				ddlOp := op.forEntry(entry, rel, table, "")
+				ddlOp.opCode = "ddl"
+				ddlOp.statement = statement
+				log.Info("Replicating DDL", "table", table, "statement", statement)
+				state.dispatch(ddlOp)
+			}
+		}
+	}
+}
+
+// columnTypeOf returns the type and type modifier of a column of a destination table, found is false
+// when the column does not exist.
+func columnTypeOf(ctx context.Context, tx pgx.Tx, table string, column string) (uint32, int32, bool, error) {
+	var oid uint32
+	var modifier int32
+	err := tx.QueryRow(ctx, `SELECT atttypid, atttypmod FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attname = $2 AND attnum > 0 AND NOT attisdropped`, table, column).Scan(&oid, &modifier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("cannot get type of column=%s, error=%w", column, err)
+	}
+	return oid, modifier, true, nil
+}
+
+// typeOf returns the type and type modifier of a type name, valid is false when the type does not exist.
+// The modifier is computed by the type modifier input function of the type from the values in parentheses.
+func typeOf(ctx context.Context, tx pgx.Tx, name string) (uint32, int32, bool, error) {
+	var oid uint32
+	var schema, function *string
+	err := tx.QueryRow(ctx, `SELECT t.oid, n.nspname, p.proname FROM pg_type t
+		LEFT JOIN pg_proc p ON p.oid = t.typmodin
+		LEFT JOIN pg_namespace n ON n.oid = p.pronamespace
+		WHERE t.oid = to_regtype($1)`, name).Scan(&oid, &schema, &function)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("cannot get type=%s, error=%w", name, err)
+	}
+	m := ddlTypeModifiers.FindStringSubmatch(name)
+	if m == nil || function == nil {
+		return oid, -1, true, nil
+	}
+	values := splitTopLevel(m[1], ',')
+	var modifier int32
+	err = tx.QueryRow(ctx, fmt.Sprintf("SELECT %s($1::text::cstring[])", pgx.Identifier{*schema, *function}.Sanitize()),
+		"{"+strings.Join(values, ",")+"}").Scan(&modifier)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("cannot get modifier of type=%s, error=%w", name, err)
+	}
+	return oid, modifier, true, nil
+}
+
+// ddlApplied reports whether a DDL statement was already applied to a destination table.
+// Destinations shared by several sources receive the statement from each of them,
+// primary keys, type changes and renames are only applied once.
+func ddlApplied(ctx context.Context, tx pgx.Tx, table string, statement string) (bool, error) {
+	action := strings.TrimPrefix(statement, fmt.Sprintf("ALTER TABLE %s ", table))
+	if ddlAddKey.MatchString(action) {
+		var exists bool
+		err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = $1::regclass AND contype = 'p')", table).Scan(&exists)
+		if err != nil {
+			return false, fmt.Errorf("cannot get primary key, error=%w", err)
+		}
+		return exists, nil
+	}
+	if m := ddlAlterType.FindStringSubmatch(action); m != nil {
+		oid, modifier, found, err := columnTypeOf(ctx, tx, table, unquote(m[1]))
+		if err != nil || !found {
+			return false, err
+		}
+		typeOID, typeModifier, valid, err := typeOf(ctx, tx, columnType(m[2]))
+		if err != nil || !valid {
+			return false, err
+		}
+		return typeOID == oid && typeModifier == modifier, nil
+	}
+	if m := ddlRenameColumn.FindStringSubmatch(action); m != nil {
+		_, _, fromFound, err := columnTypeOf(ctx, tx, table, unquote(m[1]))
+		if err != nil {
+			return false, err
+		}
+		_, _, toFound, err := columnTypeOf(ctx, tx, table, unquote(m[2]))
+		if err != nil {
+			return false, err
+		}
+		return !fromFound && toFound, nil
+	}
+	return false, nil
+}
+
+// executeDDL applies a DDL statement unless it was already applied by another source of the destination.
+func (op operation) executeDDL(tx pgx.Tx) error {
+	log := op.log.With("op", "executeDDL", "table", op.destTable)
+
+	t0 := time.Now()
+	log.Debug("ddl", "statement", op.statement)
+	applied, err := ddlApplied(context.Background(), tx, op.destTable, op.statement)
+	if err == nil && applied {
+		log.Info("Skipping DDL already applied", "statement", op.statement)
+		return nil
+	}
+	if err == nil {
+		_, err = tx.Exec(context.Background(), op.statement)
+	}
+	if err != nil {
+		log.Error("can't apply ddl", "statement", op.statement, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "ddl", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "ddl", "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("executeDDL failed, error=%w", err)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "ddl", "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "ddl", "success").Observe(time.Since(t0).Seconds())
+	return nil
+}
+
+// applyDDL applies a DDL statement and commits it before publishing the new destination metadata,
+// so that other workers never use a column that is not committed yet. The following operations are
+// applied in a new transaction, they are dropped and their sources restarted if the commit fails.
+func (w *Worker) applyDDL(op operation, following []operation) error {
+	ctx := context.Background()
+	if err := w.apply(op); err != nil {
+		return err
+	}
+	unapplied := make(map[string]pglogrepl.LSN)
+	for _, f := range following {
+		if lsn, ok := unapplied[f.database+"-"+f.sid]; !ok || f.lsn < lsn {
+			unapplied[f.database+"-"+f.sid] = f.lsn
+		}
+	}
+	if err := w.commit(unapplied); err != nil {
+		return err
+	}
+	for dbsid := range unapplied {
+		w.sources[dbsid] = true
+	}
+	if err := refreshDestTables(ctx); err != nil {
+		w.log.Error("cannot refresh destination metadata", "error", err)
+	}
+	if len(following) == 0 {
+		return nil
+	}
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction, error=%w", err)
+	}
+	w.tx = tx
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAlterTableActions(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"alter table t1 add column extra text", []string{"add column extra text"}},
+		{"ALTER TABLE public.t1 ADD a int, ADD b numeric(10,2) DEFAULT 0;", []string{"ADD a int", "ADD b numeric(10,2) DEFAULT 0"}},
+		{`ALTER TABLE IF EXISTS ONLY "T1" ADD x int`, nil},
+		{`ALTER TABLE "t1" ALTER COLUMN name TYPE varchar(40)`, []string{"ALTER COLUMN name TYPE varchar(40)"}},
+		{"alter table private.t1 add x int", nil},
+		{"alter table t2 add x int; alter table t1 drop column garbage", []string{"drop column garbage"}},
+		{"alter table t1 add c text default 'a,b;c'", []string{"add c text default 'a,b;c'"}},
+		{"create index on t1(name)", nil},
+	}
+	for _, tt := range tests {
+		if got := alterTableActions(tt.query, "public", "t1"); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestColumnType(t *testing.T) {
+	tests := map[string]string{
+		"int":                             "int",
+		"numeric(10, 2) not null":         "numeric(10, 2)",
+		"text default 'x' collate \"C\"":  "text",
+		"timestamp with time zone NULL":   "timestamp with time zone",
+		"varchar(20) USING name::varchar": "varchar(20)",
+	}
+	for definition, want := range tests {
+		if got := columnType(definition); got != want {
+			t.Errorf("%q: got %q, want %q", definition, got, want)
+		}
+	}
+}
+
+func TestTranslateDDL(t *testing.T) {
+	defer setDestTables(DestTables())
+	setDestTables(PGTables{
+		"public.t1":  {Columns: map[string]PGColumn{"sid": {Name: "sid"}, "id": {Name: "id"}}},
+		"public.rt1": {Columns: map[string]PGColumn{"id": {Name: "id"}}},
+	})
+	entry := MappingEntry{
+		Columns: map[string]string{"name": "full_name", "Code": "ExternalCode"},
+		Exclude: []string{"garbage"},
+	}
+	actions := []string{
+		"ADD COLUMN extra text NOT NULL DEFAULT ''",
+		"add garbage2 int",
+		"ADD COLUMN garbage int",
+		"ALTER COLUMN name TYPE varchar(40)",
+		"ALTER salary SET DATA TYPE bigint USING salary::bigint",
+		"RENAME COLUMN extra TO more",
+		"RENAME name TO first_name",
+		`ADD "Amount" numeric(10,2)`,
+		"ALTER COLUMN Total TYPE bigint",
+		`ALTER COLUMN "Code" TYPE text`,
+		`RENAME COLUMN "Label" TO "Title"`,
+		"ADD PRIMARY KEY (id, name)",
+		"ADD CONSTRAINT t1_name_key UNIQUE (name)",
+		"RENAME TO t9",
+		"DROP COLUMN extra",
+	}
+	tests := []struct {
+		destTable string
+		keys      bool
+		want      []string
+	}{
+		{"public.t1", true, []string{
+			`ALTER TABLE public.t1 ADD COLUMN IF NOT EXISTS "extra" text`,
+			`ALTER TABLE public.t1 ADD COLUMN IF NOT EXISTS "garbage2" int`,
+			`ALTER TABLE public.t1 ALTER COLUMN "full_name" TYPE varchar(40)`,
+			`ALTER TABLE public.t1 ALTER COLUMN "salary" TYPE bigint`,
+			`ALTER TABLE public.t1 RENAME COLUMN "extra" TO "more"`,
+			`ALTER TABLE public.t1 ADD COLUMN IF NOT EXISTS "Amount" numeric(10,2)`,
+			`ALTER TABLE public.t1 ALTER COLUMN "total" TYPE bigint`,
+			`ALTER TABLE public.t1 ALTER COLUMN "ExternalCode" TYPE text`,
+			`ALTER TABLE public.t1 RENAME COLUMN "Label" TO "Title"`,
+			`ALTER TABLE public.t1 ADD PRIMARY KEY ("sid", "id", "full_name")`,
+		}},
+		{"public.rt1", false, []string{
+			`ALTER TABLE public.rt1 ADD COLUMN IF NOT EXISTS "extra" text`,
+			`ALTER TABLE public.rt1 ADD COLUMN IF NOT EXISTS "garbage2" int`,
+			`ALTER TABLE public.rt1 ALTER COLUMN "full_name" TYPE varchar(40)`,
+			`ALTER TABLE public.rt1 ALTER COLUMN "salary" TYPE bigint`,
+			`ALTER TABLE public.rt1 RENAME COLUMN "extra" TO "more"`,
+			`ALTER TABLE public.rt1 ADD COLUMN IF NOT EXISTS "Amount" numeric(10,2)`,
+			`ALTER TABLE public.rt1 ALTER COLUMN "total" TYPE bigint`,
+			`ALTER TABLE public.rt1 ALTER COLUMN "ExternalCode" TYPE text`,
+			`ALTER TABLE public.rt1 RENAME COLUMN "Label" TO "Title"`,
+		}},
+	}
+	for _, tt := range tests {
+		got := translateDDL(log, entry, tt.destTable, actions, tt.keys)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.destTable, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+const deadLetterTable = "kvsz_dead_letter"
+
+type (
+	// deadLetterPayload is the part of an operation needed to apply it again.
+	deadLetterPayload struct {
+		Relation       PGRelation     `json:"relation"`
+		Values         map[string]any `json:"values,omitempty"`
+		Old            uint8          `json:"old,omitempty"`
+		OldValues      map[string]any `json:"old_values,omitempty"`
+		TruncateOption uint8          `json:"truncate_option,omitempty"`
+		CommitTime     time.Time      `json:"commit_time"`
+		Xid            uint32         `json:"xid,omitempty"`
+		Statement      string         `json:"statement,omitempty"`
+	}
+
+	DeadLetter struct {
+		ID          int64           `json:"id"`
+		Database    string          `json:"database"`
+		SID         string          `json:"sid"`
+		SourceTable string          `json:"source_table"`
+		DestTable   string          `json:"dest_table"`
+		OpCode      string          `json:"op_code"`
+		Payload     json.RawMessage `json:"payload"`
+		LSN         string          `json:"lsn"`
+		Error       string          `json:"error"`
+		Attempts    int             `json:"attempts"`
+		CreatedAt   time.Time       `json:"created_at"`
+		UpdatedAt   time.Time       `json:"updated_at"`
+	}
+)
+
+var (
+	errNoAffectedRows = errors.New("no affected rows")
+
+	// deadLetterTypeMap decodes the values of dead letters from their text representation.
+	deadLetterTypeMap = pgtype.NewMap()
+)
+
+func deadLetterTableName() string {
+	return joinSchema(config.Database.Schema, deadLetterTable)
+}
+
+func createDeadLetterTable(conn *pgx.Conn) error {
+	_, err := conn.Exec(context.Background(), fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		id bigserial PRIMARY KEY,
+		database text NOT NULL,
+		sid text NOT NULL,
+		source_table text NOT NULL,
+		dest_table text NOT NULL,
+		op_code text NOT NULL,
+		payload jsonb NOT NULL,
+		lsn pg_lsn NOT NULL,
+		error text NOT NULL,
+		attempts integer NOT NULL DEFAULT 1,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		updated_at timestamptz NOT NULL DEFAULT now())`, deadLetterTableName()))
+	if err != nil {
+		return fmt.Errorf("cannot create dead letter table, error=%w", err)
+	}
+	return nil
+}
+
+// execute runs a single operation in the destination transaction.
+func (op operation) execute(tx pgx.Tx) error {
+	switch op.opCode {
+	case "ic":
+		return op.insertClone(tx)
+	case "uc":
+		return op.updateClone(tx)
+	case "dc":
+		return op.deleteClone(tx)
+	case "tc":
+		return op.truncateClone(tx)
+	case "ih":
+		return op.insertHistory(tx)
+	case "uh":
+		return op.updateHistory(tx)
+	case "dh":
+		return op.deleteHistory(tx)
+	case "th":
+		return op.truncateHistory(tx)
+	case "u4":
+		return op.updateHistory4(tx)
+	case "d4":
+		return op.deleteHistory4(tx)
+	case "t4":
+		return op.truncateHistory4(tx)
+	case "is":
+		return op.insertSoftDelete(tx)
+	case "ds":
+		return op.deleteSoftDelete(tx)
+	case "ts":
+		return op.truncateSoftDelete(tx)
+	case "ie":
+		return op.insertEvent(tx, "insert")
+	case "ue":
+		return op.insertEvent(tx, "update")
+	case "de":
+		return op.insertEvent(tx, "delete")
+	case "te":
+		return op.insertEvent(tx, "truncate")
+	case "ddl":
+		return op.executeDDL(tx)
+	default:
+		return fmt.Errorf("unhandled opcode: %s", op.opCode)
+	}
+}
+
+// deadLetter stores a failed operation in the dead letter table.
+// It is written in the same transaction as the successful operations
+// so that it is never lost when the source position is confirmed.
+// It returns an error when the dead letter cannot be written, the transaction is then aborted.
+func (op operation) deadLetter(tx pgx.Tx, opError error) error {
+	log := op.log.With("op", "deadLetter", "table", op.destTable)
+	payload, err := json.Marshal(deadLetterPayload{
+		Relation:       op.relation,
+		Values:         op.values,
+		Old:            op.old,
+		OldValues:      op.oldValues,
+		TruncateOption: op.truncateOption,
+		CommitTime:     op.commitTime,
+		Xid:            op.xid,
+		Statement:      op.statement,
+	})
+	if err != nil {
+		log.Error("cannot marshal dead letter payload, operation lost", "op", op, "error", err)
+		return nil
+	}
+	_, err = tx.Exec(context.Background(),
+		fmt.Sprintf(`INSERT INTO %s (database, sid, source_table, dest_table, op_code, payload, lsn, error)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)`, deadLetterTableName()),
+		op.database, op.sid, op.sourceTable, op.destTable, op.opCode, payload, op.lsn.String(), opError.Error())
+	if err != nil {
+		return fmt.Errorf("cannot write dead letter, table=%s, lsn=%s, error=%w", op.destTable, op.lsn, err)
+	}
+	deadLettersTotal.WithLabelValues(op.database, op.sid, op.sourceTable).Inc()
+	log.Warn("Operation moved to dead letter table", "lsn", op.lsn, "error", opError)
+	return nil
+}
+
+// deadLetterValue converts a value decoded from JSON to the type of its column, so that
+// large integers keep their precision and binary, time and uuid values their type.
+// Values of columns missing in the relation, like constants, are kept as decoded.
+func deadLetterValue(oid uint32, v any) (any, error) {
+	switch v := v.(type) {
+	case json.Number:
+		switch oid {
+		case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID:
+			return v.Int64()
+		case pgtype.Float4OID, pgtype.Float8OID:
+			return v.Float64()
+		case 0:
+			if i, err := v.Int64(); err == nil {
+				return i, nil
+			}
+			return v.Float64()
+		default:
+			return decodeTextColumnData(deadLetterTypeMap, []byte(v.String()), oid)
+		}
+	case string:
+		switch oid {
+		case pgtype.ByteaOID:
+			return base64.StdEncoding.DecodeString(v)
+		case pgtype.TimestamptzOID, pgtype.TimestampOID, pgtype.DateOID:
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	case []any:
+		if oid == pgtype.UUIDOID && len(v) == 16 {
+			var uuid [16]byte
+			for i := range v {
+				b, ok := v[i].(json.Number)
+				if !ok {
+					return nil, fmt.Errorf("invalid uuid byte: %v", v[i])
+				}
+				n, err := b.Int64()
+				if err != nil {
+					return nil, fmt.Errorf("invalid uuid, error=%w", err)
+				}
+				uuid[i] = byte(n)
+			}
+			return uuid, nil
+		}
+	}
+	return v, nil
+}
+
+// deadLetterValues converts the values of a dead letter to the types of the relation columns.
+func deadLetterValues(relation PGRelation, values map[string]any) (map[string]any, error) {
+	if values == nil {
+		return nil, nil
+	}
+	oids := make(map[string]uint32, len(relation.Columns))
+	for _, c := range relation.Columns {
+		oids[c.Name] = c.DataTypeOID
+	}
+	for k, v := range values {
+		converted, err := deadLetterValue(oids[k], v)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert dead letter column=%s, error=%w", k, err)
+		}
+		values[k] = converted
+	}
+	return values, nil
+}
+
+// operation rebuilds the operation of a dead letter to apply it again.
+func (d DeadLetter) operation() (operation, error) {
+	var payload deadLetterPayload
+	decoder := json.NewDecoder(bytes.NewReader(d.Payload))
+	decoder.UseNumber()
+	err := decoder.Decode(&payload)
+	if err != nil {
+		return operation{}, fmt.Errorf("cannot unmarshal dead letter payload, error=%w", err)
+	}
+	if payload.Values, err = deadLetterValues(payload.Relation, payload.Values); err != nil {
+		return operation{}, err
+	}
+	if payload.OldValues, err = deadLetterValues(payload.Relation, payload.OldValues); err != nil {
+		return operation{}, err
+	}
+	lsn, err := pglogrepl.ParseLSN(d.LSN)
+	if err != nil {
+		return operation{}, fmt.Errorf("invalid dead letter lsn, error=%w", err)
+	}
+	op := operation{
+		log:            log.With("db", d.Database, "sid", d.SID, "dead_letter", d.ID),
+		database:       d.Database,
+		sid:            d.SID,
+		opCode:         d.OpCode,
+		sourceTable:    d.SourceTable,
+		destTable:      d.DestTable,
+		relation:       payload.Relation,
+		values:         payload.Values,
+		old:            payload.Old,
+		oldValues:      payload.OldValues,
+		lsn:            lsn,
+		truncateOption: payload.TruncateOption,
+		commitTime:     payload.CommitTime,
+		xid:            payload.Xid,
+		statement:      payload.Statement,
+	}
+	_, op.destTableHasSID = DestTables()[d.DestTable].Columns["sid"]
+	entry, err := MappingTable().FindByDestination(d.Database, joinSchema(payload.Relation.Namespace, payload.Relation.RelationName), d.DestTable)
+	if err != nil {
+		return operation{}, fmt.Errorf("cannot find mapping of dead letter, error=%w", err)
+	}
+	op.id = entry.ID
+	op.history = entry.history
+	return op, nil
+}
+
+func scanDeadLetter(row pgx.Row) (DeadLetter, error) {
+	var d DeadLetter
+	err := row.Scan(&d.ID, &d.Database, &d.SID, &d.SourceTable, &d.DestTable, &d.OpCode,
+		&d.Payload, &d.LSN, &d.Error, &d.Attempts, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return d, fmt.Errorf("cannot scan dead letter, error=%w", err)
+	}
+	return d, nil
+}
+
+const deadLetterColumns = `id, database, sid, source_table, dest_table, op_code, payload, lsn::text, error, attempts, created_at, updated_at`
+
+func getDeadLetters(ctx context.Context, m SQLModifier) ([]DeadLetter, error) {
+	result := make([]DeadLetter, 0)
+	query := BuildQuery(fmt.Sprintf("SELECT %s FROM %s", deadLetterColumns, deadLetterTableName()), m)
+	rows, err := DestConnectionPool.Query(ctx, query)
+	if err != nil {
+		return result, fmt.Errorf("cannot read dead letters, error=%w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		d, err := scanDeadLetter(rows)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, d)
+	}
+	if err = rows.Err(); err != nil {
+		return result, fmt.Errorf("cannot read dead letters, error=%w", err)
+	}
+	return result, nil
+}
+
+// retryDeadLetter applies a dead letter again and removes it on success.
+// On failure, the error and the number of attempts are updated.
+func retryDeadLetter(ctx context.Context, id int64) error {
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot begin transaction, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	d, err := scanDeadLetter(tx.QueryRow(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE id=$1 FOR UPDATE", deadLetterColumns, deadLetterTableName()), id))
+	if err != nil {
+		return err
+	}
+	op, err := d.operation()
+	if err != nil {
+		return err
+	}
+	opError := op.execute(tx)
+	if opError != nil && !errors.Is(opError, errNoAffectedRows) {
+		_ = tx.Rollback(ctx)
+		_, err = DestConnectionPool.Exec(ctx,
+			fmt.Sprintf("UPDATE %s SET attempts=attempts+1, error=$2, updated_at=now() WHERE id=$1", deadLetterTableName()),
+			id, opError.Error())
+		if err != nil {
+			log.Error("cannot update dead letter", "id", id, "error", err)
+		}
+		return opError
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE id=$1", deadLetterTableName()), id)
+	if err != nil {
+		return fmt.Errorf("cannot delete dead letter, error=%w", err)
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit dead letter retry, error=%w", err)
+	}
+	if op.opCode == "ddl" {
+		return refreshDestTables(ctx)
+	}
+	return nil
+}
+
+func deleteDeadLetter(ctx context.Context, id int64) (bool, error) {
+	result, err := DestConnectionPool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE id=$1", deadLetterTableName()), id)
+	if err != nil {
+		return false, fmt.Errorf("cannot delete dead letter, error=%w", err)
+	}
+	return result.RowsAffected() == 1, nil
+}
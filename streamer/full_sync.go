@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -20,12 +25,32 @@ type (
 		CommandChannel  chan string
 		rowsTotal       prometheus.Counter
 		bytesTotal      prometheus.Counter
+		rows            int64
+		size            int64
+		// closed by the writer when it exits, writeErr is set before
+		done     chan struct{}
+		writeErr error
 	}
-)
 
-var size int64
+	// syncChunk is a part of a source table copied in a single COPY statement.
+	// A chunk is either the whole table, a partition or a primary key range.
+	syncChunk struct {
+		sourceTable string
+		destTable   string
+		from        string
+		where       string
+		index       int
+		count       int
+		// table written instead of destTable, used to copy into a shadow table
+		into string
+		// chunk copied outside of the initial sync, its state is not recorded
+		untracked bool
+		// position of the snapshot of a chunk copied after streaming started, older changes are skipped
+		snapshotLSN pglogrepl.LSN
+	}
+)
 
-func (s syncChannel) Read(p []byte) (int, error) {
+func (s *syncChannel) Read(p []byte) (int, error) {
 	select {
 	case command := <-s.CommandChannel:
 		log.Debug("received command", "command", command)
@@ -36,50 +61,184 @@ func (s syncChannel) Read(p []byte) (int, error) {
 	}
 }
 
-func (s syncChannel) Write(p []byte) (int, error) {
+func (s *syncChannel) Write(p []byte) (int, error) {
 	err := lim.Wait(context.Background())
 	if err != nil {
 		return 0, fmt.Errorf("cannot wait for token, error=%w", err)
 	}
 	row := slices.Clone(p)
-	size += int64(len(row))
+	select {
+	case s.SyncDataChannel <- row:
+	case <-s.done:
+		return 0, errors.New("destination writer stopped")
+	}
+	s.rows++
+	s.size += int64(len(row))
 	s.rowsTotal.Inc()
 	s.bytesTotal.Add(float64(len(row)))
-	s.SyncDataChannel <- row
 	return len(p), nil
 }
 
-func writeDestination(log *slog.Logger, tableName string, hasSID bool, columns string, s *syncChannel) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3600)
-	defer cancel()
-	conn, err := DestConnectionPool.Acquire(ctx)
-	defer conn.Release()
-	if err != nil {
-		log.Error("cannot acquire connection to destination database", "error", err)
-		return
-	}
+// writeDestination copies the rows read from the source in a destination table.
+func writeDestination(ctx context.Context, log *slog.Logger, tx pgx.Tx, tableName string, hasSID bool, columns string, s *syncChannel) {
+	defer close(s.done)
 	var tag pgconn.CommandTag
+	var err error
 	if hasSID {
-		tag, err = conn.Conn().PgConn().CopyFrom(ctx, s, fmt.Sprintf("COPY %s(sid, %s) FROM STDIN;", tableName, columns))
+		tag, err = tx.Conn().PgConn().CopyFrom(ctx, s, fmt.Sprintf("COPY %s(sid, %s) FROM STDIN;", tableName, columns))
 	} else {
-		tag, err = conn.Conn().PgConn().CopyFrom(ctx, s, fmt.Sprintf("COPY %s(%s) FROM STDIN;", tableName, columns))
+		tag, err = tx.Conn().PgConn().CopyFrom(ctx, s, fmt.Sprintf("COPY %s(%s) FROM STDIN;", tableName, columns))
 	}
 	if err != nil {
 		log.Error("cannot COPY FROM", "table", tableName, "error", err)
+		s.writeErr = fmt.Errorf("cannot write destination table=%s, error=%w", tableName, err)
 		return
 	}
 	log.Debug("COPY FROM", "tag", tag)
 }
 
+// syncEntries returns the entries of the destination tables of a chunk. A chunk copied into another
+// table is only copied for its own destination, events tables only receive changes.
+func syncEntries(db string, chunk syncChunk) ([]MappingEntry, error) {
+	entries, err := MappingTable().FindAllByName(db, chunk.sourceTable)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]MappingEntry, 0, len(entries))
+	for _, entry := range entries {
+		if chunk.into != "" {
+			if entry.destTable() == chunk.destTable {
+				result = append(result, entry)
+			}
+			continue
+		}
+		if entry.Replicated && entry.Type != TableTypeEvents {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
+
+// syncColumn is a column of a destination table copied from a source column or set to a constant.
+type syncColumn struct {
+	name     string
+	source   string
+	constant any
+}
+
+// expression returns the expression selecting the value of the column in the source.
+func (c syncColumn) expression() string {
+	if c.source != "" {
+		return c.source
+	}
+	return sqlLiteral(c.constant)
+}
+
+// value returns the value of the column for a source row.
+func (c syncColumn) value(row map[string]any) any {
+	if c.source != "" {
+		return row[c.source]
+	}
+	return c.constant
+}
+
+// sqlLiteral returns a constant as a quoted SQL literal, it is converted to the type of the column when it is written.
+func sqlLiteral(value any) string {
+	if value == nil {
+		return "NULL"
+	}
+	return "'" + strings.ReplaceAll(fmt.Sprint(value), "'", "''") + "'"
+}
+
+// syncColumns returns the columns of a destination table copied from the source table,
+// applying the column renames, exclusions and constants of the entry as streaming does.
+func syncColumns(entry MappingEntry, destTableName string) ([]syncColumn, bool) {
+	hasSID := false
+	columns := make([]syncColumn, 0)
+	for c := range DestTables()[destTableName].Columns {
+		if strings.HasPrefix(c, "kvsz_") || entry.history.isColumn(c) {
+			continue
+		}
+		if c == "sid" {
+			hasSID = true
+			continue
+		}
+		if constant, ok := entry.Constants[c]; ok {
+			columns = append(columns, syncColumn{name: c, constant: constant})
+			continue
+		}
+		source := entry.sourceColumn(c)
+		if _, ok := entry.SourceColumns[source]; !ok {
+			log.Debug("Target column not found in source table", "column", c, "table", destTableName)
+			continue
+		}
+		columns = append(columns, syncColumn{name: c, source: source})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns, hasSID
+}
+
+// syncTable copies a chunk of a source table in all its destination tables
+// and marks the chunk done in the same destination transaction.
 func syncTable(log *slog.Logger,
 	db string,
 	sid string,
-	sourceTableName string,
-	destTableName string,
+	chunk syncChunk,
+	sourceConnection *pgx.Conn) error {
+	log = log.With("sourceTable", chunk.sourceTable, "chunk", chunk.index+1, "chunks", chunk.count)
+
+	// Find map entries of the destinations
+	entries, err := syncEntries(db, chunk)
+	if err != nil {
+		log.Error("cannot match table", "database", db, "table", chunk.sourceTable)
+		return fmt.Errorf("cannot find table: %s", chunk.sourceTable)
+	}
+	log.Debug("Found mapping entries", "entries", entries)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3600)
+	defer cancel()
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		log.Error("cannot begin transaction in destination database", "error", err)
+		return fmt.Errorf("cannot begin transaction in destination database, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	for _, entry := range entries {
+		if entry.compiledTarget != nil {
+			err = syncRouted(ctx, log, db, sid, chunk, entry, tx, sourceConnection)
+		} else {
+			err = syncDestination(ctx, log, db, sid, chunk, entry, tx, sourceConnection.PgConn())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = setChunkState(ctx, tx, db, sid, chunk, SyncStateDone); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit full sync, source=%s, error=%w", chunk.sourceTable, err)
+	}
+	return nil
+}
+
+// syncDestination copies a chunk in the destination table of an entry, or in the table of the chunk
+// when it is copied into another table, with a COPY from the source to the destination.
+func syncDestination(ctx context.Context,
+	log *slog.Logger,
+	db string,
+	sid string,
+	chunk syncChunk,
+	entry MappingEntry,
+	tx pgx.Tx,
 	sourceConnection *pgconn.PgConn) error {
-	log = log.With("sourceTable", sourceTableName, "destTable", destTableName)
-	ctx := context.Background()
-	hasSID := false
+	sourceTableName := chunk.sourceTable
+	destTableName := entry.destTable()
+	tableName := destTableName
+	if chunk.into != "" {
+		tableName = chunk.into
+	}
+	log = log.With("destTable", tableName)
 
 	log.Debug("Starting full sync")
 	// Prepare channels between reader and writer
@@ -91,99 +250,607 @@ func syncTable(log *slog.Logger,
 		SyncDataChannel: syncDataChannel,
 		rowsTotal:       syncRowsTotal.WithLabelValues(db, sid, sourceTableName),
 		bytesTotal:      syncBytesTotal.WithLabelValues(db, sid, sourceTableName),
+		done:            make(chan struct{}),
 	}
 
-	// Find map entry for source table
-	mapentry, err := MappingTable.FindByName(db, sourceTableName)
-	if err != nil {
-		log.Error("cannot match table", "database", db, "table", sourceTableName)
-		return fmt.Errorf("cannot find table: %s", sourceTableName)
-	}
-	log.Debug("Found mapping entry", "map", MappingTable, "mapentry", mapentry)
-
 	// Prepare column list
-	columns := ""
-	for c := range DestTables[destTableName].Columns {
-		if strings.HasPrefix(c, "kvsz_") {
-			continue
-		}
-		if c == "sid" {
-			hasSID = true
-			continue
-		}
-		if _, ok := mapentry.SourceColumns[c]; !ok {
-			log.Debug("Target column not found in source table", "column", c, "mapentry.SourceColumns[c]", mapentry.SourceColumns[c])
-			continue
-		}
-		if columns == "" {
-			columns = c
-		} else {
-			columns = fmt.Sprintf("%s, %s", columns, c)
-		}
+	c, hasSID := syncColumns(entry, destTableName)
+	names := make([]string, 0, len(c))
+	expressions := make([]string, 0, len(c))
+	for i := range c {
+		names = append(names, c[i].name)
+		expressions = append(expressions, c[i].expression())
 	}
-	log.Debug("Target columns", "columns", columns)
+	columns := strings.Join(names, ", ")
+	selected := strings.Join(expressions, ", ")
+	log.Debug("Target columns", "columns", columns, "selected", selected)
 
 	// Start writer
-	go writeDestination(log, destTableName, hasSID, columns, s)
+	go writeDestination(ctx, log, tx, tableName, hasSID, columns, s)
 
 	// Start reader
 	var copyStatement string
 	if hasSID {
-		copyStatement = fmt.Sprintf("COPY (SELECT '%s', %s FROM %s) TO STDOUT;", sid, columns, sourceTableName)
+		copyStatement = fmt.Sprintf("COPY (SELECT '%s', %s FROM %s%s) TO STDOUT;", sid, selected, chunk.from, chunk.where)
 	} else {
-		copyStatement = fmt.Sprintf("COPY (SELECT %s FROM %s) TO STDOUT;", columns, sourceTableName)
+		copyStatement = fmt.Sprintf("COPY (SELECT %s FROM %s%s) TO STDOUT;", selected, chunk.from, chunk.where)
 	}
 	t0 := time.Now()
-	size = 0
 	tag, err := sourceConnection.CopyTo(ctx, s, copyStatement)
+
+	// Stop writer and wait for the end of the COPY in the destination
+	select {
+	case commandChannel <- "stop":
+	case <-s.done:
+	}
+	<-s.done
 	if err != nil {
 		log.Error("cannot read source table", "error", err)
-		return fmt.Errorf("cannot perform full sync, error reading source=%s, dest=%s, error=%w", sourceTableName, destTableName, err)
+		return fmt.Errorf("cannot perform full sync, error reading source=%s, dest=%s, error=%w", sourceTableName, tableName, err)
+	}
+	if s.writeErr != nil {
+		return fmt.Errorf("cannot perform full sync, error writing source=%s, dest=%s, error=%w", sourceTableName, tableName, s.writeErr)
 	}
 	log.Info("Finished full sync",
 		"tag", tag,
+		"rows", s.rows,
 		"duration", time.Since(t0), "size",
-		size, "throughput",
-		(float64(size) / (time.Since(t0).Seconds()) / 1024 / 1024))
+		s.size, "throughput",
+		(float64(s.size) / (time.Since(t0).Seconds()) / 1024 / 1024))
+	return nil
+}
+
+// routedBatch holds rows of a chunk routed to a destination table by a target expression.
+type routedBatch struct {
+	table   string
+	columns []syncColumn
+	hasSID  bool
+	rows    [][]any
+}
 
-	// Stop writer
-	commandChannel <- "stop"
+// routedBatchSize is the number of rows sent at once to a destination table by syncRouted.
+const routedBatchSize = 1000
+
+func (b *routedBatch) flush(ctx context.Context, tx pgx.Tx) error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	columns := make([]string, 0, len(b.columns)+1)
+	if b.hasSID {
+		columns = append(columns, "sid")
+	}
+	for _, c := range b.columns {
+		columns = append(columns, c.name)
+	}
+	schema, table := splitSchema(b.table)
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{schema, table}, columns, pgx.CopyFromRows(b.rows))
+	if err != nil {
+		return fmt.Errorf("cannot write destination table=%s, error=%w", b.table, err)
+	}
+	b.rows = b.rows[:0]
 	return nil
 }
 
-func syncAllTables(
+// syncRouted copies a chunk in the destination tables computed by the target expression of an entry.
+// The rows are read in the snapshot, routed one by one and written in batches to each destination table.
+func syncRouted(ctx context.Context,
 	log *slog.Logger,
 	db string,
 	sid string,
-	sourceTables SourceTables,
-	sourceConnection *pgconn.PgConn) error {
-	log.Info("Starting full sync for all tables", "sourceTables", sourceTables)
-	for sourceTableName := range sourceTables {
-		destTableName, err := sourceTables.GetTable(sourceTableName)
+	chunk syncChunk,
+	entry MappingEntry,
+	tx pgx.Tx,
+	sourceConnection *pgx.Conn) error {
+	log = log.With("target_expression", entry.TargetExpression)
+	log.Debug("Starting routed full sync")
+	t0 := time.Now()
+	rows, err := sourceConnection.Query(ctx, fmt.Sprintf("SELECT * FROM %s%s", chunk.from, chunk.where))
+	if err != nil {
+		return fmt.Errorf("cannot perform full sync, error reading source=%s, error=%w", chunk.sourceTable, err)
+	}
+	defer rows.Close()
+
+	_, sourceTableName := splitSchema(chunk.sourceTable)
+	rowsTotal := syncRowsTotal.WithLabelValues(db, sid, chunk.sourceTable)
+	op := operation{database: db, sid: sid}
+	fields := rows.FieldDescriptions()
+	batches := make(map[string]*routedBatch)
+	var count int64
+	for rows.Next() {
+		if err = lim.Wait(ctx); err != nil {
+			return fmt.Errorf("cannot wait for token, error=%w", err)
+		}
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("cannot perform full sync, error reading source=%s, error=%w", chunk.sourceTable, err)
+		}
+		row := make(map[string]any, len(fields))
+		env := make(map[string]any, len(fields))
+		for i, f := range fields {
+			row[f.Name] = values[i]
+			name := f.Name
+			if name == "type" {
+				name = "_type"
+			}
+			env[name] = convertCELValue(sourceConnection.TypeMap(), f.DataTypeOID, values[i])
+		}
+		destTable, err := route(entry, op.withMetadata(env, "insert", sourceTableName, nil))
 		if err != nil {
+			log.Error("cannot route row, skipping", "error", err)
+			continue
+		}
+		b, ok := batches[destTable]
+		if !ok {
+			if _, exists := DestTables()[destTable]; !exists {
+				return fmt.Errorf("destination table does not exist, table=%s", destTable)
+			}
+			b = &routedBatch{table: destTable}
+			b.columns, b.hasSID = syncColumns(entry, destTable)
+			batches[destTable] = b
+		}
+		r := make([]any, 0, len(b.columns)+1)
+		if b.hasSID {
+			r = append(r, sid)
+		}
+		for _, c := range b.columns {
+			r = append(r, c.value(row))
+		}
+		b.rows = append(b.rows, r)
+		if len(b.rows) >= routedBatchSize {
+			if err = b.flush(ctx, tx); err != nil {
+				return err
+			}
+		}
+		count++
+		rowsTotal.Inc()
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("cannot perform full sync, error reading source=%s, error=%w", chunk.sourceTable, err)
+	}
+	for _, b := range batches {
+		if err = b.flush(ctx, tx); err != nil {
 			return err
 		}
-		log.Info("Syncing", "sourceTable", sourceTableName, "destTable", destTableName)
-		_ = syncTable(log, db, sid, sourceTableName, destTableName, sourceConnection)
 	}
+	log.Info("Finished routed full sync", "rows", count, "tables", len(batches), "duration", time.Since(t0))
 	return nil
 }
 
-func syncNewTables(
+// connectSnapshot opens a regular connection to the source database and starts a read only
+// repeatable read transaction. If a snapshot name is provided, the transaction imports it so
+// that all reads see the database exactly as of the replication slot consistent point.
+func connectSnapshot(ctx context.Context, log *slog.Logger, db string, sourceURL string, snapshotName string) (*pgx.Conn, error) {
+	databaseURL := strings.Split(sourceURL, "?")[0] + "?application_name=kuvasz_sync_" + db
+	parsedConfig, err := pgx.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse url=%s, error=%w", databaseURL, err)
+	}
+	parsedConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	conn, err := pgx.ConnectConfig(ctx, parsedConfig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to source database for full sync, error=%w", err)
+	}
+	_, err = conn.Exec(ctx, "BEGIN ISOLATION LEVEL REPEATABLE READ READ ONLY")
+	if err != nil {
+		conn.Close(ctx)
+		return nil, fmt.Errorf("cannot start full sync transaction, error=%w", err)
+	}
+	if snapshotName != "" {
+		log.Debug("Importing snapshot", "snapshot", snapshotName)
+		_, err = conn.Exec(ctx, "SET TRANSACTION SNAPSHOT '"+snapshotName+"'")
+		if err != nil {
+			conn.Close(ctx)
+			return nil, fmt.Errorf("cannot import snapshot=%s, error=%w", snapshotName, err)
+		}
+	}
+	return conn, nil
+}
+
+// integerPrimaryKey returns the primary key of a source table if it is made of a single integer column.
+func integerPrimaryKey(entry MappingEntry) (string, bool) {
+	pk := ""
+	for name, column := range entry.SourceColumns {
+		if !column.PrimaryKey {
+			continue
+		}
+		if pk != "" {
+			return "", false
+		}
+		pk = name
+	}
+	if pk == "" {
+		return "", false
+	}
+	switch entry.SourceColumns[pk].ColumnType {
+	case "int2", "int4", "int8":
+		return pk, true
+	default:
+		return "", false
+	}
+}
+
+// planChunks splits a source table into chunks. Partitioned tables are split by partition,
+// tables with an integer primary key are split into app.sync_chunks ranges of keys.
+// Bounds are read in the sync snapshot so that chunks cover exactly the rows of the snapshot.
+func planChunks(ctx context.Context, log *slog.Logger, conn *pgx.Conn, db string, sourceTableName string, destTableName string) ([]syncChunk, error) {
+	whole := []syncChunk{{sourceTable: sourceTableName, destTable: destTableName, from: sourceTableName, count: 1}}
+	entry, err := MappingTable().FindByName(db, sourceTableName)
+	if err != nil {
+		return whole, nil //nolint:nilerr // syncTable reports unmapped tables
+	}
+	if len(entry.Partitions) > 0 {
+		chunks := make([]syncChunk, 0, len(entry.Partitions))
+		for i, partition := range entry.Partitions {
+			chunks = append(chunks, syncChunk{
+				sourceTable: sourceTableName,
+				destTable:   destTableName,
+				from:        joinSchema(entry.Schema, partition),
+				index:       i,
+				count:       len(entry.Partitions),
+			})
+		}
+		return chunks, nil
+	}
+	pk, ok := integerPrimaryKey(entry)
+	if !ok || config.App.SyncChunks <= 1 {
+		return whole, nil
+	}
+	var minKey, maxKey *int64
+	err = conn.QueryRow(ctx, fmt.Sprintf("SELECT min(%s), max(%s) FROM %s", pk, pk, sourceTableName)).Scan(&minKey, &maxKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get primary key range, table=%s, error=%w", sourceTableName, err)
+	}
+	if minKey == nil || maxKey == nil {
+		return whole, nil
+	}
+	log.Debug("Splitting table", "table", sourceTableName, "pk", pk, "min", *minKey, "max", *maxKey, "chunks", config.App.SyncChunks)
+	return keyRangeChunks(sourceTableName, destTableName, pk, *minKey, *maxKey), nil
+}
+
+// keyRangeChunks splits the keys between minKey and maxKey into app.sync_chunks ranges of the same size.
+// There are fewer chunks when there are fewer keys, the last chunk is open ended.
+func keyRangeChunks(sourceTableName string, destTableName string, pk string, minKey int64, maxKey int64) []syncChunk {
+	count := int64(config.App.SyncChunks)
+	step := (maxKey-minKey)/count + 1
+	if step == 1 && maxKey-minKey+1 < count {
+		count = maxKey - minKey + 1
+	}
+	chunks := make([]syncChunk, 0, count)
+	for i := range count {
+		lower := minKey + i*step
+		where := fmt.Sprintf(" WHERE %s >= %d AND %s < %d", pk, lower, pk, lower+step)
+		if i == count-1 {
+			where = fmt.Sprintf(" WHERE %s >= %d", pk, lower)
+		}
+		chunks = append(chunks, syncChunk{
+			sourceTable: sourceTableName,
+			destTable:   destTableName,
+			from:        sourceTableName,
+			where:       where,
+			index:       int(i),
+			count:       int(count),
+		})
+	}
+	return chunks
+}
+
+// syncChunks copies chunks over a snapshot connection until there are no more chunks.
+// Each chunk is protected by a savepoint so that a failing chunk does not abort the others.
+// It returns the number of chunks that failed.
+func syncChunks(log *slog.Logger, db string, sid string, conn *pgx.Conn, chunks <-chan syncChunk) (int, error) {
+	ctx := context.Background()
+	failed := 0
+	for chunk := range chunks {
+		log.Info("Syncing", "sourceTable", chunk.sourceTable, "destTable", chunk.destTable, "chunk", chunk.index+1, "chunks", chunk.count)
+		if err := setChunkState(ctx, DestConnectionPool, db, sid, chunk, SyncStateInProgress); err != nil {
+			return failed, err
+		}
+		if _, err := conn.Exec(ctx, "SAVEPOINT kvsz_sync"); err != nil {
+			return failed, fmt.Errorf("cannot create savepoint, error=%w", err)
+		}
+		err := syncTable(log, db, sid, chunk, conn)
+		if err != nil {
+			failed++
+			syncChunksTotal.WithLabelValues(db, sid, chunk.sourceTable, "failure").Inc()
+			if _, err = conn.Exec(ctx, "ROLLBACK TO SAVEPOINT kvsz_sync"); err != nil {
+				return failed, fmt.Errorf("cannot rollback to savepoint, error=%w", err)
+			}
+			continue
+		}
+		syncChunksTotal.WithLabelValues(db, sid, chunk.sourceTable, "success").Inc()
+	}
+	_, err := conn.Exec(ctx, "COMMIT")
+	if err != nil {
+		return failed, fmt.Errorf("cannot commit full sync transaction, error=%w", err)
+	}
+	return failed, nil
+}
+
+// copyChunks copies chunks using app.sync_parallelism connections: the provided snapshot
+// connection and additional connections importing the same snapshot.
+// It returns the number of chunks that failed.
+func copyChunks(
 	log *slog.Logger,
 	db string,
 	sid string,
+	sourceURL string,
+	snapshotName string,
+	conn *pgx.Conn,
+	chunks []syncChunk) (int, error) {
+	ctx := context.Background()
+	chunkChannel := make(chan syncChunk, len(chunks))
+	for _, chunk := range chunks {
+		chunkChannel <- chunk
+	}
+	close(chunkChannel)
+
+	// Open additional connections importing the same snapshot
+	conns := []*pgx.Conn{conn}
+	defer func() {
+		for _, c := range conns[1:] {
+			c.Close(ctx)
+		}
+	}()
+	parallelism := max(min(config.App.SyncParallelism, len(chunks)), 1)
+	for range parallelism - 1 {
+		c, err := connectSnapshot(ctx, log, db, sourceURL, snapshotName)
+		if err != nil {
+			return 0, err
+		}
+		conns = append(conns, c)
+	}
+	log.Info("Starting full sync", "chunks", len(chunks), "parallelism", parallelism)
+
+	// Copy chunks
+	var syncWG sync.WaitGroup
+	failed := make([]int, len(conns))
+	errs := make([]error, len(conns))
+	for i := range conns {
+		syncWG.Add(1)
+		go func() {
+			defer syncWG.Done()
+			failed[i], errs[i] = syncChunks(log.With("sync", i), db, sid, conns[i], chunkChannel)
+		}()
+	}
+	syncWG.Wait()
+	total := 0
+	for _, f := range failed {
+		total += f
+	}
+	return total, errors.Join(errs...)
+}
+
+// syncTables copies a list of tables using app.sync_parallelism snapshot connections.
+// All connections share the same snapshot: the exported snapshot of the replication slot
+// or, when there is none, a snapshot exported by the first connection.
+// Tables with planned chunks are not split again, only these chunks are copied.
+// The chunks of the tables with a fence record the position of the snapshot when they are done.
+// It fails if a chunk could not be copied, so that streaming does not start with missing rows.
+func syncTables(
+	log *slog.Logger,
+	db string,
+	sid string,
+	sourceURL string,
+	snapshotName string,
 	sourceTables SourceTables,
-	newTables []string,
-	sourceConnection *pgconn.PgConn) error {
+	tables []string,
+	planned map[string][]syncChunk,
+	fences map[string]pglogrepl.LSN) error {
+	ctx := context.Background()
+	conn, err := connectSnapshot(ctx, log, db, sourceURL, snapshotName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	if snapshotName == "" && config.App.SyncParallelism > 1 {
+		err = conn.QueryRow(ctx, "SELECT pg_export_snapshot()").Scan(&snapshotName)
+		if err != nil {
+			return fmt.Errorf("cannot export full sync snapshot, error=%w", err)
+		}
+	}
+
+	// Split tables in chunks
+	var chunks []syncChunk
+	for _, sourceTableName := range tables {
+		if entries, err := syncEntries(db, syncChunk{sourceTable: sourceTableName}); err == nil && len(entries) == 0 {
+			// events tables only receive changes
+			log.Info("Skipping full sync of table without synced destination", "sourceTable", sourceTableName)
+			if err = saveChunks(ctx, db, sid, sourceTableName, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		tableChunks := planned[sourceTableName]
+		if len(tableChunks) > 0 {
+			log.Info("Resuming full sync", "sourceTable", sourceTableName, "chunks", len(tableChunks))
+		} else {
+			destTableName, err := sourceTables.GetTable(sourceTableName)
+			if err != nil {
+				return err
+			}
+			tableChunks, err = planChunks(ctx, log, conn, db, sourceTableName, destTableName)
+			if err != nil {
+				return err
+			}
+			if err = saveChunks(ctx, db, sid, sourceTableName, tableChunks); err != nil {
+				return err
+			}
+		}
+		for i := range tableChunks {
+			tableChunks[i].snapshotLSN = fences[sourceTableName]
+		}
+		chunks = append(chunks, tableChunks...)
+	}
+	failed, err := copyChunks(log, db, sid, sourceURL, snapshotName, conn, chunks)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		log.Error("Some chunks could not be synced", "tables", len(tables), "chunks", len(chunks), "failed", failed)
+		return fmt.Errorf("cannot sync %d chunks of %d", failed, len(chunks))
+	}
+	return nil
+}
+
+func syncAllTables(
+	log *slog.Logger,
+	db string,
+	sid string,
+	sourceURL string,
+	snapshotName string,
+	sourceTables SourceTables) error {
+	log.Info("Starting full sync for all tables", "sourceTables", sourceTables, "snapshot", snapshotName)
+	tables := make([]string, 0, len(sourceTables))
+	for sourceTableName := range sourceTables {
+		tables = append(tables, sourceTableName)
+	}
+	return syncTables(log, db, sid, sourceURL, snapshotName, sourceTables, tables, nil, nil)
+}
+
+// sharedDestination reports whether a destination table also receives the rows of another source table.
+func sharedDestination(db string, sourceTable string, destTable string) bool {
+	schema, table := splitSchema(sourceTable)
+	for _, e := range MappingTable() {
+		if e.DBName == db && e.destTable() == destTable && (e.Schema != schema || !e.Match(table)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceCount returns the number of source URLs of a database.
+func sourceCount(db string) int {
+	for i := range dbmap {
+		if dbmap[i].Name == db {
+			return len(dbmap[i].Urls)
+		}
+	}
+	return 0
+}
+
+// clearSyncedTable deletes the rows copied from a source by an unfinished full sync of a table,
+// so that the table can be copied again from a new snapshot. It returns false without deleting
+// anything when the rows of the source cannot be told apart: destinations computed by a target
+// expression, destinations shared with other source tables, or without a sid column and shared with other sources.
+func clearSyncedTable(ctx context.Context, log *slog.Logger, db string, sid string, sourceTable string) (bool, error) {
+	entries, err := syncEntries(db, syncChunk{sourceTable: sourceTable})
+	if err != nil {
+		return false, err
+	}
+	queries := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		destTable := entry.destTable()
+		if entry.compiledTarget != nil || sharedDestination(db, sourceTable, destTable) {
+			log.Warn("Cannot clear destination of unfinished full sync", "sourceTable", sourceTable, "destTable", destTable)
+			return false, nil
+		}
+		if _, hasSID := DestTables()[destTable].Columns["sid"]; hasSID {
+			queries = append(queries, fmt.Sprintf("DELETE FROM %s WHERE sid=$1", destTable))
+			continue
+		}
+		if sourceCount(db) > 1 {
+			log.Warn("Cannot clear destination without sid column of unfinished full sync", "sourceTable", sourceTable, "destTable", destTable)
+			return false, nil
+		}
+		queries = append(queries, "TRUNCATE "+destTable)
+	}
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("cannot begin transaction in destination database, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	for _, q := range queries {
+		var arguments []any
+		if strings.HasPrefix(q, "DELETE") {
+			arguments = append(arguments, sid)
+		}
+		if _, err = tx.Exec(ctx, q, arguments...); err != nil {
+			return false, fmt.Errorf("cannot clear destination, query=%s, error=%w", q, err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return false, fmt.Errorf("cannot commit destination clear, error=%w", err)
+	}
+	log.Info("Cleared destination of unfinished full sync", "sourceTable", sourceTable)
+	return true, nil
+}
+
+// setSyncFences skips the changes of the tables copied after streaming started that are older
+// than their snapshot, as they are already part of the copied rows.
+func setSyncFences(db string, sid string, fences map[string]pglogrepl.LSN) {
+	for table, lsn := range fences {
+		setSyncFence(db, sid, table, lsn)
+	}
+}
+
+// syncNewTables copies tables added to an existing replication and resumes the sync of tables
+// that was interrupted. The slot snapshot is not available anymore, so the tables are copied from
+// the snapshot of a temporary replication slot and the changes older than this snapshot are skipped for them.
+// The rows of an interrupted table are deleted and the whole table is copied again, unless the rows of
+// the source cannot be told apart; then only the unfinished chunks are copied and older changes are applied again.
+func syncNewTables(
+	log *slog.Logger,
+	db string,
+	url *SourceURL,
+	sourceTables SourceTables,
+	newTables []string) error {
+	ctx := context.Background()
+	sid := url.SID
 	log.Info("Starting full sync for new tables", "sourceTables", sourceTables)
-	for i := range newTables {
-		destTableName, err := sourceTables.GetTable(newTables[i])
+	unfinished, err := loadUnfinishedChunks(ctx, db, sid)
+	if err != nil {
+		return err
+	}
+	if len(newTables) > 0 {
+		if err = markTablesPending(ctx, db, sid, sourceTables, newTables, false); err != nil {
+			return err
+		}
+	}
+	tables := slices.Clone(newTables)
+	fenced := slices.Clone(newTables)
+	for table := range unfinished {
+		if slices.Contains(newTables, table) {
+			delete(unfinished, table)
+			continue
+		}
+		if sourceTables.Find(table) == "" {
+			log.Info("Skipping unfinished full sync of unconfigured table", "sourceTable", table)
+			continue
+		}
+		log.Info("Found unfinished full sync", "sourceTable", table)
+		tables = append(tables, table)
+		cleared, err := clearSyncedTable(ctx, log, db, sid, table)
+		if err != nil {
+			return err
+		}
+		if !cleared {
+			continue
+		}
+		if err = markTablesPending(ctx, db, sid, sourceTables, []string{table}, false); err != nil {
+			return err
+		}
+		delete(unfinished, table)
+		fenced = append(fenced, table)
+	}
+	if len(tables) > 0 {
+		replConn, lsn, snapshotName, err := createSnapshotSlot(ctx, log, "kuvasz_sync_"+db, url)
+		if err != nil {
+			return err
+		}
+		defer replConn.Close(ctx)
+		fences := make(map[string]pglogrepl.LSN, len(fenced))
+		for _, table := range fenced {
+			fences[table] = lsn
+		}
+		err = syncTables(log, db, sid, url.URL, snapshotName, sourceTables, tables, unfinished, fences)
 		if err != nil {
 			return err
 		}
-		log.Info("Syncing", "sourceTable", newTables[i], "destTable", destTableName)
-		_ = syncTable(log, db, sid, newTables[i], destTableName, sourceConnection)
 	}
+	fences, err := loadSyncFences(ctx, db, sid)
+	if err != nil {
+		return err
+	}
+	setSyncFences(db, sid, fences)
 	return nil
 }
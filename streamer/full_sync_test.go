@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// chunkOf returns the index of the chunk holding a key, -1 when none or several chunks hold it.
+func chunkOf(t *testing.T, chunks []syncChunk, key int64) int {
+	t.Helper()
+	found := -1
+	for i, c := range chunks {
+		var lower, upper int64
+		if n, _ := fmt.Sscanf(c.where, " WHERE id >= %d AND id < %d", &lower, &upper); n == 2 {
+			if key < lower || key >= upper {
+				continue
+			}
+		} else if _, err := fmt.Sscanf(c.where, " WHERE id >= %d", &lower); err != nil {
+			t.Fatalf("unexpected chunk condition %q", c.where)
+		} else if key < lower {
+			continue
+		}
+		if found != -1 {
+			return -1
+		}
+		found = i
+	}
+	return found
+}
+
+func TestKeyRangeChunks(t *testing.T) {
+	chunks := config.App.SyncChunks
+	defer func() { config.App.SyncChunks = chunks }()
+
+	tests := []struct {
+		chunks   int
+		min, max int64
+		count    int
+	}{
+		{4, 1, 100, 4},
+		{4, 1, 10, 4},
+		{4, -50, 50, 4},
+		{4, 1, 2, 2},
+		{4, 7, 7, 1},
+		{3, 0, 1000000, 3},
+	}
+	for _, tt := range tests {
+		config.App.SyncChunks = tt.chunks
+		got := keyRangeChunks("public.t1", "t1", "id", tt.min, tt.max)
+		if len(got) != tt.count {
+			t.Errorf("[%d, %d] split in %d chunks, want %d", tt.min, tt.max, len(got), tt.count)
+			continue
+		}
+		for i, c := range got {
+			if c.index != i || c.count != tt.count || c.from != "public.t1" || c.destTable != "t1" {
+				t.Errorf("[%d, %d] chunk %d is %+v", tt.min, tt.max, i, c)
+			}
+		}
+		for _, key := range []int64{tt.min, (tt.min + tt.max) / 2, tt.max, tt.max + 1} {
+			if chunkOf(t, got, key) == -1 {
+				t.Errorf("[%d, %d] key %d is not in exactly one chunk", tt.min, tt.max, key)
+			}
+		}
+		if chunkOf(t, got, tt.min) != 0 {
+			t.Errorf("[%d, %d] first key is not in the first chunk", tt.min, tt.max)
+		}
+	}
+}
+
+func TestPlanChunks(t *testing.T) {
+	chunks := config.App.SyncChunks
+	defer func() { config.App.SyncChunks = chunks }()
+	defer setMappingTable(MappingTable())
+	config.App.SyncChunks = 4
+
+	serial := map[string]PGColumn{"id": {Name: "id", ColumnType: "int4", PrimaryKey: true}, "name": {Name: "name", ColumnType: "text"}}
+	composite := map[string]PGColumn{"a": {Name: "a", ColumnType: "int4", PrimaryKey: true}, "b": {Name: "b", ColumnType: "int4", PrimaryKey: true}}
+	text := map[string]PGColumn{"code": {Name: "code", ColumnType: "text", PrimaryKey: true}}
+	setMappingTable(mappingTable{
+		{DBName: "db1", Schema: "public", Name: "t7", Partitions: []string{"t7_0", "t7_1", "t7_2"}, SourceColumns: serial},
+		{DBName: "db1", Schema: "public", Name: "t1", SourceColumns: serial},
+		{DBName: "db1", Schema: "public", Name: "composite", SourceColumns: composite},
+		{DBName: "db1", Schema: "public", Name: "text", SourceColumns: text},
+	})
+
+	// partitioned tables are copied one partition at a time
+	got, err := planChunks(context.Background(), log, nil, "db1", "public.t7", "t7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := make([]string, 0, len(got))
+	for _, c := range got {
+		from = append(from, c.from)
+		if c.where != "" || c.count != 3 {
+			t.Errorf("partition chunk is %+v", c)
+		}
+	}
+	if want := []string{"public.t7_0", "public.t7_1", "public.t7_2"}; !slices.Equal(from, want) {
+		t.Errorf("partitions copied from %v, want %v", from, want)
+	}
+
+	// tables without a single integer key and unmapped tables are copied whole
+	for _, table := range []string{"public.composite", "public.text", "public.unknown"} {
+		got, err = planChunks(context.Background(), log, nil, "db1", table, "dest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].where != "" || got[0].from != table {
+			t.Errorf("%s planned as %+v", table, got)
+		}
+	}
+
+	// tables are copied whole when chunking is disabled
+	config.App.SyncChunks = 1
+	got, err = planChunks(context.Background(), log, nil, "db1", "public.t1", "t1")
+	if err != nil || len(got) != 1 || got[0].where != "" {
+		t.Errorf("planned %+v, error=%v", got, err)
+	}
+}
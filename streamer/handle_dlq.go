@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var dlqColumns = map[string]string{
+	"id":           "id",
+	"database":     "database",
+	"sid":          "sid",
+	"source_table": "source_table",
+	"dest_table":   "dest_table",
+	"op_code":      "op_code",
+	"lsn":          "lsn",
+	"attempts":     "attempts",
+	"created_at":   "created_at",
+	"updated_at":   "updated_at",
+}
+
+func dlqGetOneHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	id, err := ExtractID(r)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+		return
+	}
+
+	ctx := context.Background()
+	item, err := scanDeadLetter(DestConnectionPool.QueryRow(ctx,
+		fmt.Sprintf("SELECT %s FROM %s WHERE id=$1", deadLetterColumns, deadLetterTableName()), id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		req.ReturnError(w, http.StatusNotFound, "not_found", "can't find dead letter", nil)
+		return
+	}
+	if err != nil {
+		req.ReturnError(w, http.StatusInternalServerError, "SYSTEM", "can't read dead letter", err)
+		return
+	}
+	req.ReturnOK(w, r, item, 1)
+}
+
+func dlqGetManyHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+	m := ValuesToModifier(r.URL.Query(), dlqColumns)
+
+	items, err := getDeadLetters(context.Background(), m)
+	if err != nil {
+		req.ReturnError(w, http.StatusInternalServerError, "SYSTEM", "can't read dead letter list", err)
+		return
+	}
+	req.ReturnOK(w, r, items, len(items))
+}
+
+func dlqRetryHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	id, err := ExtractID(r)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+		return
+	}
+
+	err = retryDeadLetter(context.Background(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		req.ReturnError(w, http.StatusNotFound, "not_found", "can't find dead letter", nil)
+		return
+	}
+	if err != nil {
+		req.ReturnError(w, http.StatusConflict, "retry_failed", "dead letter operation failed again", err)
+		return
+	}
+	req.ReturnOK(w, r, nil, 0)
+}
+
+func dlqDeleteOneHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	id, err := ExtractID(r)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+		return
+	}
+
+	found, err := deleteDeadLetter(context.Background(), id)
+	if err != nil {
+		req.ReturnError(w, http.StatusInternalServerError, "SYSTEM", "can't delete dead letter", err)
+		return
+	}
+	if !found {
+		req.ReturnError(w, http.StatusNotFound, "NOT_FOUND", "dead letter not found", nil)
+		return
+	}
+	req.ReturnOK(w, r, nil, 0)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
+	"time"
 )
 
 func mapGetOneHandler(w http.ResponseWriter, r *http.Request) {
@@ -17,19 +19,20 @@ func mapGetOneHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Find id
-	if len(MappingTable) == 0 {
+	if len(MappingTable()) == 0 {
 		err := RefreshMappingTable()
 		if err != nil {
 			req.ReturnError(w, http.StatusInternalServerError, "internal_error", "Error refreshing mapping table", err)
 			return
 		}
 	}
-	if id < 0 || id >= int64(len(MappingTable)) {
+	entries := MappingTable()
+	if id < 0 || id >= int64(len(entries)) {
 		req.ReturnError(w, http.StatusNotFound, "invalid_id", "Invalid ID", err)
 		return
 	}
 	log := log.With("id", id)
-	result := MappingTable.FindByID(id)
+	result := entries.FindByID(id)
 	if result.DBName == "" {
 		req.ReturnError(w, http.StatusNotFound, "not_found", "Not found", nil)
 		return
@@ -40,14 +43,15 @@ func mapGetOneHandler(w http.ResponseWriter, r *http.Request) {
 
 func mapGetManyHandler(w http.ResponseWriter, r *http.Request) {
 	req := PrepareReq(w, r)
-	if len(MappingTable) == 0 {
+	if len(MappingTable()) == 0 {
 		err := RefreshMappingTable()
 		if err != nil {
 			req.ReturnError(w, http.StatusInternalServerError, "internal_error", "Error refreshing mapping table", err)
 			return
 		}
 	}
-	req.ReturnOK(w, r, MappingTable, len(MappingTable))
+	entries := MappingTable()
+	req.ReturnOK(w, r, entries, len(entries))
 }
 
 func mapCreateTableHandler(w http.ResponseWriter, r *http.Request) {
@@ -55,11 +59,12 @@ func mapCreateTableHandler(w http.ResponseWriter, r *http.Request) {
 
 	// extract id
 	id, err := ExtractID(r)
-	if err != nil || id < 0 || id >= int64(len(MappingTable)) {
+	entries := MappingTable()
+	if err != nil || id < 0 || id >= int64(len(entries)) {
 		req.ReturnError(w, http.StatusNotFound, "invalid_id", "Invalid ID", err)
 		return
 	}
-	t := MappingTable[id]
+	t := entries[id]
 	if t.Present {
 		req.ReturnError(
 			w,
@@ -92,11 +97,12 @@ func mapCloneTableHandler(w http.ResponseWriter, r *http.Request) {
 
 	// extract id
 	id, err := ExtractID(r)
-	if err != nil || id < 0 || id >= int64(len(MappingTable)) {
+	entries := MappingTable()
+	if err != nil || id < 0 || id >= int64(len(entries)) {
 		req.ReturnError(w, http.StatusNotFound, "invalid_id", "Invalid ID", err)
 		return
 	}
-	t := MappingTable[id]
+	t := entries[id]
 	log := log.With("handler", "MapReplicateTableHandler", "id", id)
 
 	// extract type
@@ -104,7 +110,7 @@ func mapCloneTableHandler(w http.ResponseWriter, r *http.Request) {
 	if tabletype == "" {
 		tabletype = TableTypeClone
 	}
-	if tabletype != TableTypeClone && tabletype != TableTypeAppend && tabletype != TableTypeHistory {
+	if !slices.Contains(tableTypes, tabletype) {
 		req.ReturnError(w, http.StatusBadRequest, "invalid_type", "Invalid type", nil)
 		return
 	}
@@ -126,19 +132,33 @@ func mapCloneTableHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Debug("Replicating table", "name", t.Name, "type", tabletype, "target", target, "regex", regex, "DestTables", DestTables)
+	log.Debug("Replicating table", "name", t.Name, "type", tabletype, "target", target, "regex", regex, "DestTables", DestTables())
 
-	// Create table if not present
-	if _, ok := DestTables[fullTargetName]; !ok {
-		q := "CREATE TABLE " + target + "("
-		first := true
-		for k, v := range t.SourceColumns {
-			if first {
-				first = false
-			} else {
-				q += ", "
-			}
-			q += k + " " + v.ColumnType //nolint:perfsprint // simpler like this
+	// Create table if not present, with the columns maintained by the streamer
+	columns := ""
+	for k, v := range t.SourceColumns {
+		if columns != "" {
+			columns += ", "
+		}
+		columns += k + " " + v.ColumnType //nolint:perfsprint // simpler like this
+	}
+	history, err := newHistoryOptions(SourceTable{Type: tabletype})
+	if err != nil {
+		req.ReturnError(w, http.StatusInternalServerError, "internal_error", "Invalid history options", err)
+		return
+	}
+	if tabletype == TableTypeEvents {
+		columns = eventColumnsDDL
+	}
+	if _, ok := DestTables()[fullTargetName]; !ok {
+		q := "CREATE TABLE " + target + "(" + columns
+		switch tabletype {
+		case TableTypeHistory, TableTypeHistory6:
+			q += history.columnsDDL(true)
+		case TableTypeHistory4:
+			q += history.startDDL()
+		case TableTypeSoftDelete:
+			q += fmt.Sprintf(", %s boolean not null default false", history.deleted)
 		}
 		q += ");"
 		log.Debug("Creating table", "name", t.Name, "columns", t.SourceColumns, "q", q)
@@ -148,6 +168,15 @@ func mapCloneTableHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if _, ok := DestTables()[historyTableName(fullTargetName)]; tabletype == TableTypeHistory4 && !ok {
+		q := "CREATE TABLE " + historyTableName(target) + "(" + columns + history.columnsDDL(false) + ");"
+		log.Debug("Creating history table", "name", t.Name, "columns", t.SourceColumns, "q", q)
+		_, err = DestConnectionPool.Exec(context.Background(), q)
+		if err != nil {
+			req.ReturnError(w, http.StatusInternalServerError, "cannot create table", q, err)
+			return
+		}
+	}
 
 	// Now add it to config
 	log.Debug("Adding entry to tbl", "db_id", t.DBId, "name", t.Name, "target", target, "regex", regex)
@@ -180,3 +209,68 @@ func mapRefreshHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	req.ReturnOK(w, r, nil, 0)
 }
+
+func mapResyncHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	// extract id
+	id, err := ExtractID(r)
+	entries := MappingTable()
+	if err != nil || id < 0 || id >= int64(len(entries)) {
+		req.ReturnError(w, http.StatusNotFound, "invalid_id", "Invalid ID", err)
+		return
+	}
+	t := entries[id]
+	log := log.With("handler", "mapResyncHandler", "id", id)
+
+	// extract mode and sid
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = ResyncModeTruncate
+	}
+	sid := r.URL.Query().Get("sid")
+	urls, allSIDs, err := validateResync(t, mode, sid)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "cannot_resync", "Cannot resync table", err)
+		return
+	}
+
+	status := ResyncStatus{
+		ID:        id,
+		Table:     joinSchema(t.Schema, t.Name),
+		Mode:      mode,
+		State:     ResyncStateRunning,
+		StartedAt: time.Now(),
+	}
+	for _, url := range urls {
+		status.SIDs = append(status.SIDs, url.SID)
+	}
+	if !startResyncJob(status) {
+		req.ReturnError(w, http.StatusConflict, "conflict", "resync already running", nil)
+		return
+	}
+	go func() {
+		err := resyncTable(log, t, t.DBName, urls, mode, allSIDs)
+		if err != nil {
+			log.Error("Cannot resync table", "table", status.Table, "error", err)
+		}
+		finishResyncJob(id, err)
+	}()
+	req.ReturnAccepted(w, r, status, 1)
+}
+
+func mapGetResyncHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	id, err := ExtractID(r)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+		return
+	}
+	status, ok := getResyncJob(id)
+	if !ok {
+		req.ReturnError(w, http.StatusNotFound, "not_found", "no resync for this table", nil)
+		return
+	}
+	req.ReturnOK(w, r, status, 1)
+}
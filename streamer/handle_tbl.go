@@ -10,28 +10,97 @@ import (
 )
 
 type tbl struct {
-	ID              int64   `json:"id"`
-	DBId            int64   `json:"db_id"`
-	DBName          string  `json:"db_name"`
-	Schema          string  `json:"schema"`
-	Name            string  `json:"name"`
-	Type            string  `json:"type"`
-	Target          string  `json:"target"`
-	PartitionsRegex *string `json:"partitions_regex"`
+	ID                  int64   `json:"id"`
+	DBId                int64   `json:"db_id"`
+	DBName              string  `json:"db_name"`
+	Schema              string  `json:"schema"`
+	Name                string  `json:"name"`
+	Type                string  `json:"type"`
+	Target              string  `json:"target"`
+	TargetExpression    *string `json:"target_expression"`
+	PartitionsRegex     *string `json:"partitions_regex"`
+	HistoryTime         *string `json:"history_time"`
+	HistoryStart        *string `json:"history_start"`
+	HistoryEnd          *string `json:"history_end"`
+	HistoryDeleted      *string `json:"history_deleted"`
+	HistoryCurrent      *string `json:"history_current"`
+	HistoryVersion      *string `json:"history_version"`
+	HistoryOpenEnd      *string `json:"history_open_end"`
+	HistoryInitialStart *string `json:"history_initial_start"`
+	SoftDeleteColumn    *string `json:"soft_delete_column"`
+	SchemaEvolution     *string `json:"schema_evolution"`
 }
 
 var tblColumns = map[string]string{
-	"id":               "tbl.tbl_id",
-	"db_id":            "tbl.db_id",
-	"schema":           "tbl.schema",
-	"name":             "tbl.name",
-	"type":             "tbl.type",
-	"target":           "tbl.target",
-	"partitions_regex": "tbl.partitions_regex",
+	"id":                    "tbl.tbl_id",
+	"db_id":                 "tbl.db_id",
+	"schema":                "tbl.schema",
+	"name":                  "tbl.name",
+	"type":                  "tbl.type",
+	"target":                "tbl.target",
+	"target_expression":     "tbl.target_expression",
+	"partitions_regex":      "tbl.partitions_regex",
+	"history_time":          "tbl.history_time",
+	"history_start":         "tbl.history_start",
+	"history_end":           "tbl.history_end",
+	"history_deleted":       "tbl.history_deleted",
+	"history_current":       "tbl.history_current",
+	"history_version":       "tbl.history_version",
+	"history_open_end":      "tbl.history_open_end",
+	"history_initial_start": "tbl.history_initial_start",
+	"soft_delete_column":    "tbl.soft_delete_column",
+	"schema_evolution":      "tbl.schema_evolution",
 }
 
-func tblGetOneHandler(w http.ResponseWriter, r *http.Request) {
+const tblSelect = `SELECT tbl.tbl_id, tbl.db_id, db.name as db_name, tbl.schema, tbl.name, tbl.type, tbl.target, tbl.target_expression, tbl.partitions_regex,
+		tbl.history_time, tbl.history_start, tbl.history_end, tbl.history_deleted, tbl.history_current, tbl.history_version,
+		tbl.history_open_end, tbl.history_initial_start, tbl.soft_delete_column, tbl.schema_evolution
+		FROM tbl INNER JOIN DB on tbl.db_id = db.db_id`
+
+// hasTarget checks that the destination table is configured or computed by an expression.
+func (t tbl) hasTarget() bool {
+	return t.Target != "" || (t.TargetExpression != nil && *t.TargetExpression != "")
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTbl(row scanner) (tbl, error) {
 	var item tbl
+	err := row.Scan(&item.ID, &item.DBId, &item.DBName, &item.Schema, &item.Name, &item.Type, &item.Target, &item.TargetExpression, &item.PartitionsRegex,
+		&item.HistoryTime, &item.HistoryStart, &item.HistoryEnd, &item.HistoryDeleted, &item.HistoryCurrent, &item.HistoryVersion,
+		&item.HistoryOpenEnd, &item.HistoryInitialStart, &item.SoftDeleteColumn, &item.SchemaEvolution)
+	return item, err //nolint:wrapcheck // callers distinguish sql.ErrNoRows
+}
+
+// newTbl returns the API representation of a table of the map file.
+func newTbl(db SourceDatabase, name string, t SourceTable) tbl {
+	schema, table := splitSchema(name)
+	return tbl{
+		ID:                  t.ID,
+		DBId:                db.ID,
+		DBName:              db.Name,
+		Schema:              schema,
+		Name:                table,
+		Type:                t.Type,
+		Target:              t.Target,
+		TargetExpression:    &t.TargetExpression,
+		PartitionsRegex:     &t.PartitionsRegex,
+		HistoryTime:         &t.HistoryTime,
+		HistoryStart:        &t.HistoryStart,
+		HistoryEnd:          &t.HistoryEnd,
+		HistoryDeleted:      &t.HistoryDeleted,
+		HistoryCurrent:      &t.HistoryCurrent,
+		HistoryVersion:      &t.HistoryVersion,
+		HistoryOpenEnd:      &t.HistoryOpenEnd,
+		HistoryInitialStart: &t.HistoryInitialStart,
+		SoftDeleteColumn:    &t.SoftDeleteColumn,
+		SchemaEvolution:     &t.SchemaEvolution,
+	}
+}
+
+func tblGetOneHandler(w http.ResponseWriter, r *http.Request) {
 	req := PrepareReq(w, r)
 
 	id, err := ExtractID(r)
@@ -45,17 +114,7 @@ func tblGetOneHandler(w http.ResponseWriter, r *http.Request) {
 		for i := range dbmap {
 			for j := range dbmap[i].Tables {
 				if dbmap[i].Tables[j].ID == id {
-					item.ID = dbmap[i].Tables[j].ID
-					item.DBId = dbmap[i].ID
-					item.DBName = dbmap[i].Name
-					schema, table := splitSchema(j)
-					item.Schema = schema
-					item.Name = table
-					item.Type = dbmap[i].Tables[j].Type
-					item.Target = dbmap[i].Tables[j].Target
-					regex := dbmap[i].Tables[j].PartitionsRegex
-					item.PartitionsRegex = &regex
-					req.ReturnOK(w, r, item, 1)
+					req.ReturnOK(w, r, newTbl(dbmap[i], j, dbmap[i].Tables[j]), 1)
 					return
 				}
 			}
@@ -66,12 +125,7 @@ func tblGetOneHandler(w http.ResponseWriter, r *http.Request) {
 
 	// database mode
 	ctx := context.Background()
-	err = ConfigDB.QueryRowContext(
-		ctx,
-		`SELECT tbl.tbl_id, tbl.db_id, db.name as db_name, tbl.schema, tbl.name, tbl.type, tbl.target, tbl.partitions_regex 
-		FROM tbl INNER JOIN DB on tbl.db_id = db.db_id
-		WHERE tbl_id = ?`,
-		id).Scan(&item.ID, &item.DBId, &item.DBName, &item.Schema, &item.Name, &item.Type, &item.Target, &item.PartitionsRegex)
+	item, err := scanTbl(ConfigDB.QueryRowContext(ctx, tblSelect+" WHERE tbl_id = ?", id))
 	if errors.Is(err, sql.ErrNoRows) {
 		req.ReturnError(w, http.StatusNotFound, "not_found", "can't find table", nil)
 		return
@@ -93,19 +147,7 @@ func tblGetManyHandler(w http.ResponseWriter, r *http.Request) {
 	if config.App.MapDatabase == "" {
 		for i := range dbmap {
 			for j := range dbmap[i].Tables {
-				schema, table := splitSchema(j)
-				regex := dbmap[i].Tables[j].PartitionsRegex
-				item := tbl{
-					ID:              dbmap[i].Tables[j].ID,
-					DBId:            dbmap[i].ID,
-					DBName:          dbmap[i].Name,
-					Schema:          schema,
-					Name:            table,
-					Type:            dbmap[i].Tables[j].Type,
-					Target:          dbmap[i].Tables[j].Target,
-					PartitionsRegex: &regex,
-				}
-				tbls = append(tbls, item)
+				tbls = append(tbls, newTbl(dbmap[i], j, dbmap[i].Tables[j]))
 			}
 		}
 		req.ReturnOK(w, r, tbls, len(tbls))
@@ -113,10 +155,7 @@ func tblGetManyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// database mode
-	query := BuildQuery(
-		`SELECT tbl.tbl_id, tbl.db_id, db.name as db_name, tbl.schema, tbl.name, tbl.type, tbl.target, tbl.partitions_regex 
-		FROM tbl INNER JOIN DB on tbl.db_id = db.db_id`,
-		m)
+	query := BuildQuery(tblSelect, m)
 	log.Debug("running query", "query", query, "modifier", m, "values", r.URL.Query())
 	ctx := context.Background()
 	rows, err := ConfigDB.QueryContext(ctx, query)
@@ -126,8 +165,7 @@ func tblGetManyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var item tbl
-		err := rows.Scan(&item.ID, &item.DBId, &item.DBName, &item.Schema, &item.Name, &item.Type, &item.Target, &item.PartitionsRegex)
+		item, err := scanTbl(rows)
 		if err != nil {
 			req.ReturnError(w, http.StatusInternalServerError, "SYSTEM", "can't scan item", err)
 			return
@@ -157,7 +195,7 @@ func tblPostOneHandler(w http.ResponseWriter, r *http.Request) {
 		req.ReturnError(w, http.StatusBadRequest, "0003", "JSON parse error", err)
 		return
 	}
-	if item.DBId == 0 || item.Name == "" || item.Type == "" || item.Target == "" {
+	if item.DBId == 0 || item.Name == "" || item.Type == "" || !item.hasTarget() {
 		req.ReturnError(w, http.StatusBadRequest, "0003", "Missing parameters", nil)
 		return
 	}
@@ -167,8 +205,13 @@ func tblPostOneHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	result, err := ConfigDB.ExecContext(
 		ctx,
-		`INSERT INTO tbl(db_id, schema, name, type, target, partitions_regex) VALUES (?, ?, ?, ?, ?, ?)`,
-		item.DBId, item.Schema, item.Name, item.Type, item.Target, item.PartitionsRegex)
+		`INSERT INTO tbl(db_id, schema, name, type, target, target_expression, partitions_regex,
+		history_time, history_start, history_end, history_deleted, history_current, history_version, history_open_end, history_initial_start,
+		soft_delete_column, schema_evolution)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		item.DBId, item.Schema, item.Name, item.Type, item.Target, item.TargetExpression, item.PartitionsRegex,
+		item.HistoryTime, item.HistoryStart, item.HistoryEnd, item.HistoryDeleted, item.HistoryCurrent, item.HistoryVersion,
+		item.HistoryOpenEnd, item.HistoryInitialStart, item.SoftDeleteColumn, item.SchemaEvolution)
 	if err != nil {
 		req.ReturnError(w, http.StatusBadRequest, "0003", "Database error", err)
 		return
@@ -227,7 +270,7 @@ func tblPutOneHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// err = app.Validate.Struct(item)
-	if item.DBId == 0 || item.Schema == "" || item.Name == "" || item.Type == "" || item.Target == "" {
+	if item.DBId == 0 || item.Schema == "" || item.Name == "" || item.Type == "" || !item.hasTarget() {
 		req.ReturnError(w, http.StatusBadRequest, "0003", "Missing parameters", nil)
 		return
 	}
@@ -237,8 +280,12 @@ func tblPutOneHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	result, err := ConfigDB.ExecContext(
 		ctx,
-		`UPDATE tbl set schema=?, name=?, type=?, target=?, partitions_regex=? where tbl_id=?`,
-		item.Schema, item.Name, item.Type, item.Target, item.PartitionsRegex, id)
+		`UPDATE tbl set schema=?, name=?, type=?, target=?, target_expression=?, partitions_regex=?,
+		history_time=?, history_start=?, history_end=?, history_deleted=?, history_current=?, history_version=?, history_open_end=?, history_initial_start=?,
+		soft_delete_column=?, schema_evolution=? where tbl_id=?`,
+		item.Schema, item.Name, item.Type, item.Target, item.TargetExpression, item.PartitionsRegex,
+		item.HistoryTime, item.HistoryStart, item.HistoryEnd, item.HistoryDeleted, item.HistoryCurrent, item.HistoryVersion,
+		item.HistoryOpenEnd, item.HistoryInitialStart, item.SoftDeleteColumn, item.SchemaEvolution, id)
 	if err != nil {
 		req.ReturnError(w, http.StatusBadRequest, "0003", "Database error", err)
 		return
@@ -19,6 +19,27 @@ type URL struct {
 	Error  string `json:"error"`
 }
 
+type (
+	URLWorkerStatus struct {
+		Worker       int    `json:"worker"`
+		WrittenLSN   string `json:"written_lsn"`
+		CommittedLSN string `json:"committed_lsn"`
+	}
+	URLStatus struct {
+		ID                int64             `json:"id"`
+		DBName            string            `json:"db_name"`
+		SID               string            `json:"sid"`
+		Up                bool              `json:"up"`
+		Status            string            `json:"status"`
+		Error             string            `json:"error"`
+		ConfirmedLSN      string            `json:"confirmed_lsn"`
+		LagBytes          float64           `json:"lag_bytes"`
+		LagSeconds        float64           `json:"lag_seconds"`
+		SlotRetainedBytes float64           `json:"slot_retained_bytes"`
+		Workers           []URLWorkerStatus `json:"workers"`
+	}
+)
+
 var URLColumns = map[string]string{
 	"id":    "url.db_id",
 	"db_id": "url.db_id",
@@ -48,6 +69,7 @@ func urlGetOneHandler(w http.ResponseWriter, r *http.Request) {
 					item.SID = dbmap[i].Urls[j].SID
 					item.URL = dbmap[i].Urls[j].URL
 					item.Up = getStatus(item.DBName, item.SID)
+					item.Status = getURLState(item.DBName, item.SID)
 					req.ReturnOK(w, r, item, 1)
 					return
 				}
@@ -72,6 +94,7 @@ func urlGetOneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	item.Up = getStatus(item.DBName, item.SID)
+	item.Status = getURLState(item.DBName, item.SID)
 	req.ReturnOK(w, r, item, 1)
 }
 
@@ -92,6 +115,7 @@ func urlGetManyHandler(w http.ResponseWriter, r *http.Request) {
 					SID:    dbmap[i].Urls[j].SID,
 					URL:    dbmap[i].Urls[j].URL,
 					Up:     getStatus(dbmap[i].Name, dbmap[i].Urls[j].SID),
+					Status: getURLState(dbmap[i].Name, dbmap[i].Urls[j].SID),
 				}
 				urls = append(urls, item)
 			}
@@ -120,6 +144,7 @@ func urlGetManyHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		item.Up = getStatus(item.DBName, item.SID)
+		item.Status = getURLState(item.DBName, item.SID)
 		item.Error = URLError[item.URL]
 		urls = append(urls, item)
 	}
@@ -242,11 +267,73 @@ func urlPutOneHandler(w http.ResponseWriter, r *http.Request) {
 func urlPostRestartAllHandler(w http.ResponseWriter, r *http.Request) {
 	req := PrepareReq(w, r)
 	RootChannel <- "restart"
-
-	// for i := range dbmap {
-	// 	for j := range dbmap[i].Urls {
-	// 		dbmap[i].Urls[j].commandChannel <- "restart"
-	// 	}
-	// }
 	req.ReturnOK(w, r, nil, 0)
 }
+
+// urlPostCommandHandler sends a command to the replication of a single source URL.
+// Other source URLs are not interrupted.
+func urlPostCommandHandler(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := PrepareReq(w, r)
+
+		id, err := ExtractID(r)
+		if err != nil {
+			req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+			return
+		}
+		database, url := findSourceURL(id)
+		if url == nil {
+			req.ReturnError(w, http.StatusNotFound, "not_found", "can't find url", nil)
+			return
+		}
+		log.Info("Sending command to url", "command", command, "db-sid", database+"-"+url.SID)
+		err = sendURLCommand(url, command)
+		if err != nil {
+			req.ReturnError(w, http.StatusConflict, "not_running", "cannot send command to url", err)
+			return
+		}
+		req.ReturnAccepted(w, r, nil, 0)
+	}
+}
+
+func urlGetStatusHandler(w http.ResponseWriter, r *http.Request) {
+	req := PrepareReq(w, r)
+
+	id, err := ExtractID(r)
+	if err != nil {
+		req.ReturnError(w, http.StatusBadRequest, "invalid_id", "Invalid ID", err)
+		return
+	}
+	database, url := findSourceURL(id)
+	if url == nil {
+		req.ReturnError(w, http.StatusNotFound, "not_found", "can't find url", nil)
+		return
+	}
+
+	item := URLStatus{
+		ID:                id,
+		DBName:            database,
+		SID:               url.SID,
+		Up:                getStatus(database, url.SID),
+		Status:            getURLState(database, url.SID),
+		Error:             URLError[url.URL],
+		LagBytes:          getMetricValue(lagBytes.WithLabelValues(database, url.SID)),
+		LagSeconds:        getMetricValue(lagSeconds.WithLabelValues(database, url.SID)),
+		SlotRetainedBytes: getMetricValue(slotRetainedBytes.WithLabelValues(database, url.SID)),
+		Workers:           make([]URLWorkerStatus, 0),
+	}
+	for i, status := range GetSourceStatus(database, url.SID) {
+		if status.ConfirmedLSN > 0 {
+			item.ConfirmedLSN = status.ConfirmedLSN.String()
+		}
+		if status.WrittenLSN == 0 && status.CommittedLSN == 0 {
+			continue
+		}
+		item.Workers = append(item.Workers, URLWorkerStatus{
+			Worker:       i,
+			WrittenLSN:   status.WrittenLSN.String(),
+			CommittedLSN: status.CommittedLSN.String(),
+		})
+	}
+	req.ReturnOK(w, r, item, 1)
+}
@@ -19,21 +19,35 @@ import (
 
 const (
 	// table types.
-	TableTypeAppend  = "append"
-	TableTypeHistory = "history"
-	TableTypeClone   = "clone"
-	StatusStarting   = "starting"
-	StatusActive     = "active"
-	StatusStopping   = "stopping"
+	TableTypeAppend     = "append"
+	TableTypeHistory    = "history"
+	TableTypeHistory4   = "history4"
+	TableTypeHistory6   = "history6"
+	TableTypeClone      = "clone"
+	TableTypeEvents     = "events"
+	TableTypeSoftDelete = "softdelete"
+	StatusStarting      = "starting"
+	StatusActive        = "active"
+	StatusStopping      = "stopping"
+
+	// apply modes.
+	ApplyModeBatch         = "batch"
+	ApplyModeTransactional = "transactional"
+
+	// schema evolution modes.
+	SchemaEvolutionAddColumns = "add_columns"
+	SchemaEvolutionFull       = "full"
 )
 
+// tableTypes lists the supported table types.
+var tableTypes = []string{TableTypeClone, TableTypeAppend, TableTypeHistory, TableTypeHistory4, TableTypeHistory6, TableTypeSoftDelete, TableTypeEvents}
+
 var (
 	Package            string
 	Version            string
 	Build              string
 	ConfigDB           *sql.DB
 	DestConnectionPool *pgxpool.Pool
-	DestTables         PGTables
 	dbmap              DBMap
 	URLError           = make(map[string]string)
 	RootChannel        chan string
@@ -94,6 +108,7 @@ func main() {
 		for _, database := range dbmap {
 			for i, url := range database.Urls {
 				log.Info("Starting replication thread", "db-sid", database.Name+"-"+url.SID, "url", url.URL)
+				database.Urls[i].commandChannel = make(chan string)
 				wg.Add(1)
 				go DoReplicateDatabase(rootContext, database, &database.Urls[i])
 			}
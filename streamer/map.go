@@ -30,18 +30,35 @@ type (
 		commandChannel chan string
 	}
 	SourceTable struct {
-		ID              int64             `json:"tbl_id"`
-		Type            string            `json:"type"             yaml:"type,omitempty"`
-		Target          string            `json:"target"           yaml:"target,omitempty"`
-		Filter          string            `json:"filter"           yaml:"filter,omitempty"`
-		Set             map[string]string `json:"set"              yaml:"set,omitempty"`
-		Insert          string            `json:"insert"           yaml:"insert,omitempty"`
-		PartitionsRegex string            `json:"partitions_regex" yaml:"partitions_regex,omitempty"`
-		compiledRegex   *regexp.Regexp
+		ID                  int64             `json:"tbl_id"`
+		Type                string            `json:"type"                  yaml:"type,omitempty"`
+		Target              string            `json:"target"                yaml:"target,omitempty"`
+		TargetExpression    string            `json:"target_expression"     yaml:"target_expression,omitempty"`
+		Filter              string            `json:"filter"                yaml:"filter,omitempty"`
+		Set                 map[string]string `json:"set"                   yaml:"set,omitempty"`
+		Columns             map[string]string `json:"columns"               yaml:"columns,omitempty"`
+		Exclude             []string          `json:"exclude"               yaml:"exclude,omitempty"`
+		Constants           map[string]any    `json:"constants"             yaml:"constants,omitempty"`
+		Insert              string            `json:"insert"                yaml:"insert,omitempty"`
+		PartitionsRegex     string            `json:"partitions_regex"      yaml:"partitions_regex,omitempty"`
+		HistoryTime         string            `json:"history_time"          yaml:"history_time,omitempty"`
+		HistoryStart        string            `json:"history_start"         yaml:"history_start,omitempty"`
+		HistoryEnd          string            `json:"history_end"           yaml:"history_end,omitempty"`
+		HistoryDeleted      string            `json:"history_deleted"       yaml:"history_deleted,omitempty"`
+		HistoryCurrent      string            `json:"history_current"       yaml:"history_current,omitempty"`
+		HistoryVersion      string            `json:"history_version"       yaml:"history_version,omitempty"`
+		HistoryOpenEnd      string            `json:"history_open_end"      yaml:"history_open_end,omitempty"`
+		HistoryInitialStart string            `json:"history_initial_start" yaml:"history_initial_start,omitempty"`
+		SoftDeleteColumn    string            `json:"soft_delete_column"    yaml:"soft_delete_column,omitempty"`
+		SchemaEvolution     string            `json:"schema_evolution"      yaml:"schema_evolution,omitempty"`
+		Targets             []SourceTable     `json:"targets"               yaml:"targets,omitempty"`
+		compiledRegex       *regexp.Regexp
 	}
 	SourceTables map[string]SourceTable
 )
 
+// ReadMapDatabase reads the map from the map database. A source table has one row per destination,
+// the row with the lowest id is the source table and the others are its additional targets.
 func ReadMapDatabase(db *sql.DB) (DBMap, error) {
 	var jsonData string
 	fullMap := DBMap{}
@@ -63,17 +80,28 @@ func ReadMapDatabase(db *sql.DB) (DBMap, error) {
 			WHERE u.db_id = d.db_id
 		  ),
 		  'tables', (
-			SELECT json_group_object(
-				t.schema || "." || t.name,
+			SELECT json_group_array(
 			  json_object(
 				'tbl_id', t.tbl_id,
+				'schema', t.schema,
+				'name', t.name,
 				'type', t.type,
 				'target', t.target,
-				'partitions_regex', t.partitions_regex
+				'target_expression', t.target_expression,
+				'partitions_regex', t.partitions_regex,
+				'history_time', t.history_time,
+				'history_start', t.history_start,
+				'history_end', t.history_end,
+				'history_deleted', t.history_deleted,
+				'history_current', t.history_current,
+				'history_version', t.history_version,
+				'history_open_end', t.history_open_end,
+				'history_initial_start', t.history_initial_start,
+				'soft_delete_column', t.soft_delete_column,
+				'schema_evolution', t.schema_evolution
 			  )
 			)
-			FROM tbl t
-			WHERE t.db_id = d.db_id
+			FROM (SELECT * FROM tbl WHERE tbl.db_id = d.db_id ORDER BY tbl_id) t
 		  )
 		)
 	  )
@@ -82,10 +110,32 @@ func ReadMapDatabase(db *sql.DB) (DBMap, error) {
 		log.Error("Can't read config database", "error", err)
 		return fullMap, fmt.Errorf("can't read database, error=%w", err)
 	}
-	err = json.Unmarshal([]byte(jsonData), &fullMap)
+	var rows []struct {
+		SourceDatabase
+		Tables []struct {
+			Schema string `json:"schema"`
+			Name   string `json:"name"`
+			SourceTable
+		} `json:"tables"`
+	}
+	err = json.Unmarshal([]byte(jsonData), &rows)
 	if err != nil {
 		return fullMap, fmt.Errorf("can't unmarshal config database, error=%w", err)
 	}
+	for _, row := range rows {
+		database := row.SourceDatabase
+		database.Tables = make(SourceTables)
+		for _, t := range row.Tables {
+			name := joinSchema(t.Schema, t.Name)
+			if first, ok := database.Tables[name]; ok {
+				first.Targets = append(first.Targets, t.SourceTable)
+				database.Tables[name] = first
+				continue
+			}
+			database.Tables[name] = t.SourceTable
+		}
+		fullMap = append(fullMap, database)
+	}
 	log.Info("Read map database", "map", fullMap)
 	return fullMap, nil
 }
@@ -124,11 +174,9 @@ func ReadMapFile(filename string) (DBMap, error) {
 		for k, v := range db.Tables {
 			schema, table := splitSchema(k)
 			v.ID = tblid
-			if v.Type == "" {
-				v.Type = "clone"
-			}
-			if v.Target == "" {
-				v.Target = table
+			v.setDefaults(table)
+			for i := range v.Targets {
+				v.Targets[i].setDefaults(table)
 			}
 			t[joinSchema(schema, table)] = v
 			tblid++
@@ -140,6 +188,31 @@ func ReadMapFile(filename string) (DBMap, error) {
 	return m, nil
 }
 
+// setDefaults clones a source table in the destination table with the same name
+// unless another type, target or target expression is configured.
+func (t *SourceTable) setDefaults(table string) {
+	if t.Type == "" {
+		t.Type = "clone"
+	}
+	if t.Target == "" && t.TargetExpression == "" {
+		t.Target = table
+	}
+}
+
+// destinations returns the configurations of the destination tables of a source table:
+// the table itself followed by its additional targets. Partitions are a property of the
+// source table, additional targets share them.
+func (t SourceTable) destinations() []SourceTable {
+	first := t
+	first.Targets = nil
+	result := []SourceTable{first}
+	for _, d := range t.Targets {
+		d.PartitionsRegex = t.PartitionsRegex
+		result = append(result, d)
+	}
+	return result
+}
+
 func (m DBMap) CompileRegexes() {
 	log.Debug("Compiling partition regexes")
 	for _, db := range m {
@@ -206,18 +279,22 @@ func (s SourceTables) Find(t string) string {
 
 func (s SourceTables) GetTable(table string) (string, error) {
 	var destTable string
-	log.Debug("GetTable", "table", table, "sourceTables", s, "DestTables", DestTables)
+	log.Debug("GetTable", "table", table, "sourceTables", s, "DestTables", DestTables())
 	sourceTable := s.Find(table)
 	if sourceTable == "" {
 		return "", fmt.Errorf("unconfigured source table=%s", table)
 	}
 	t := s[sourceTable]
+	if t.TargetExpression != "" {
+		// the destination is computed for each row
+		return "", nil
+	}
 	if t.Target == "" {
 		destTable = sourceTable
 	} else {
 		destTable = joinSchema(config.Database.Schema, t.Target)
 	}
-	_, ok := DestTables[destTable]
+	_, ok := DestTables()[destTable]
 	if !ok {
 		return "", fmt.Errorf("destination table does not exist, table=%s", destTable)
 	}
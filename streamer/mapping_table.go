@@ -4,31 +4,42 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"slices"
 	"sort"
+	"sync"
+	"sync/atomic"
 
 	"github.com/google/cel-go/cel"
 )
 
 type MappingEntry struct {
-	ID              int64               `json:"id"`
-	DBId            int64               `json:"db_id"`
-	DBName          string              `json:"db_name"`
-	Schema          string              `json:"schema"`
-	Table           string              `json:"table"`
-	Name            string              `json:"name"`
-	Type            string              `json:"type"`
-	Target          string              `json:"target"`
-	Filter          string              `json:"filter"`
-	Set             map[string]string   `json:"set"`
-	Partitions      []string            `json:"partitions"`
-	PartitionsRegex *string             `json:"partitions_regex"`
-	Replicated      bool                `json:"replicated"`
-	Present         bool                `json:"present"`
-	SourceColumns   map[string]PGColumn `json:"source_columns"`
-	DestColumns     map[string]PGColumn `json:"dest_columns"`
-	compiledRegex   *regexp.Regexp
-	compiledFilter  cel.Program
-	compiledSet     map[string]cel.Program
+	ID               int64               `json:"id"`
+	DBId             int64               `json:"db_id"`
+	DBName           string              `json:"db_name"`
+	Schema           string              `json:"schema"`
+	Table            string              `json:"table"`
+	Name             string              `json:"name"`
+	Type             string              `json:"type"`
+	Target           string              `json:"target"`
+	TargetExpression string              `json:"target_expression"`
+	Filter           string              `json:"filter"`
+	Set              map[string]string   `json:"set"`
+	Columns          map[string]string   `json:"columns"`
+	Exclude          []string            `json:"exclude"`
+	Constants        map[string]any      `json:"constants"`
+	Partitions       []string            `json:"partitions"`
+	PartitionsRegex  *string             `json:"partitions_regex"`
+	HistoryTime      string              `json:"history_time"`
+	SchemaEvolution  string              `json:"schema_evolution"`
+	Replicated       bool                `json:"replicated"`
+	Present          bool                `json:"present"`
+	SourceColumns    map[string]PGColumn `json:"source_columns"`
+	DestColumns      map[string]PGColumn `json:"dest_columns"`
+	compiledRegex    *regexp.Regexp
+	compiledFilter   cel.Program
+	compiledSet      map[string]cel.Program
+	compiledTarget   cel.Program
+	history          historyOptions
 }
 
 type mappingTable []MappingEntry
@@ -41,7 +52,13 @@ func (m mappingTable) Less(i, j int) bool {
 	if m[i].DBId > m[j].DBId {
 		return false
 	}
-	return m[i].Name < m[j].Name
+	if m[i].Name != m[j].Name {
+		return m[i].Name < m[j].Name
+	}
+	if m[i].Target != m[j].Target {
+		return m[i].Target < m[j].Target
+	}
+	return m[i].TargetExpression < m[j].TargetExpression
 }
 func (m mappingTable) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
 
@@ -80,10 +97,126 @@ func (m mappingTable) FindByName(db string, name string) (MappingEntry, error) {
 	return MappingEntry{}, fmt.Errorf("table not found, db:%s, table: %s", db, table)
 }
 
-var MappingTable mappingTable
+// FindAllByName returns the entries of all the destinations of a source table.
+func (m mappingTable) FindAllByName(db string, name string) ([]MappingEntry, error) {
+	schema, table := splitSchema(name)
+	var result []MappingEntry
+	for i := range m {
+		if m[i].DBName == db && m[i].Schema == schema && m[i].Match(table) {
+			result = append(result, m[i])
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("table not found, db:%s, table: %s", db, table)
+	}
+	return result, nil
+}
+
+// FindByDestination returns the entry of a source table writing to a destination table.
+// Destinations computed by a target expression match any table.
+func (m mappingTable) FindByDestination(db string, name string, destTable string) (MappingEntry, error) {
+	entries, err := m.FindAllByName(db, name)
+	if err != nil {
+		return MappingEntry{}, err
+	}
+	for _, e := range entries {
+		if e.compiledTarget == nil && (e.destTable() == destTable || (e.Type == TableTypeHistory4 && historyTableName(e.destTable()) == destTable)) {
+			return e, nil
+		}
+	}
+	for _, e := range entries {
+		if e.compiledTarget != nil {
+			return e, nil
+		}
+	}
+	return MappingEntry{}, fmt.Errorf("destination not found, db:%s, table: %s, destination: %s", db, name, destTable)
+}
+
+// destTable returns the destination table of an entry, it is empty when it is computed by a target expression.
+func (e MappingEntry) destTable() string {
+	if e.TargetExpression != "" {
+		return ""
+	}
+	return joinSchema(config.Database.Schema, e.Target)
+}
+
+// mapColumns renames, excludes and adds the constant columns of an entry to the values of a row.
+func (e MappingEntry) mapColumns(values map[string]any) map[string]any {
+	if values == nil || (len(e.Columns) == 0 && len(e.Exclude) == 0 && len(e.Constants) == 0) {
+		return values
+	}
+	result := make(map[string]any, len(values)+len(e.Constants))
+	for c, v := range values {
+		if slices.Contains(e.Exclude, c) {
+			continue
+		}
+		if d, ok := e.Columns[c]; ok {
+			c = d
+		}
+		result[c] = v
+	}
+	for c, v := range e.Constants {
+		result[c] = v
+	}
+	return result
+}
+
+// mapRelation renames and excludes the columns of a relation so that keys are found in the mapped values.
+func (e MappingEntry) mapRelation(rel PGRelation) PGRelation {
+	if len(e.Columns) == 0 && len(e.Exclude) == 0 {
+		return rel
+	}
+	columns := make([]PGColumn, 0, len(rel.Columns))
+	for _, c := range rel.Columns {
+		if slices.Contains(e.Exclude, c.Name) {
+			continue
+		}
+		if d, ok := e.Columns[c.Name]; ok {
+			c.Name = d
+		}
+		columns = append(columns, c)
+	}
+	rel.Columns = columns
+	return rel
+}
+
+// sourceColumn returns the source column copied to a destination column, it is empty when there is none.
+func (e MappingEntry) sourceColumn(dest string) string {
+	for s, d := range e.Columns {
+		if d == dest && !slices.Contains(e.Exclude, s) {
+			return s
+		}
+	}
+	if _, renamed := e.Columns[dest]; renamed || slices.Contains(e.Exclude, dest) {
+		return ""
+	}
+	return dest
+}
+
+var (
+	// mappingTables holds the current mapping table, it is replaced as a whole when it is refreshed.
+	mappingTables atomic.Pointer[mappingTable]
+	// metadataLock serializes the refreshes of the destination metadata and of the mapping table.
+	metadataLock sync.Mutex
+)
+
+// MappingTable returns the current mapping table. It must not be modified.
+func MappingTable() mappingTable {
+	if m := mappingTables.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+func setMappingTable(m mappingTable) {
+	mappingTables.Store(&m)
+}
 
-func RefreshMappingTable() error { //nolint:gocognit
+func RefreshMappingTable() error {
 	var err error
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
 	// Step 1. Get list of destination tables
 	destConn, err := DestConnectionPool.Acquire(context.Background())
 	if err != nil {
@@ -91,10 +224,11 @@ func RefreshMappingTable() error { //nolint:gocognit
 	}
 	defer destConn.Release()
 
-	DestTables, err = GetTables(log, destConn.Conn(), config.Database.Schema)
+	tables, err := GetTables(log, destConn.Conn(), config.Database.Schema)
 	if err != nil {
 		return fmt.Errorf("can't get destination table metadata while refreshing, error=%w", err)
 	}
+	setDestTables(tables)
 
 	// Step 2. Get configured database map
 	var configuredMap DBMap
@@ -121,60 +255,103 @@ func RefreshMappingTable() error { //nolint:gocognit
 			continue
 		}
 		for k := range sourceTables {
-			configuredTable := configuredMap.findConfiguredTable(db.ID, k)
-			schema, table := splitSchema(k)
-			t := MappingEntry{
-				DBId:            db.ID,
-				DBName:          db.Name,
-				Schema:          schema,
-				Name:            table,
-				Type:            configuredTable.Type,
-				Target:          configuredTable.Target,
-				Filter:          configuredTable.Filter,
-				Set:             configuredTable.Set,
-				Partitions:      sourceTables[k].Partitions,
-				PartitionsRegex: &configuredTable.PartitionsRegex,
-				Replicated:      (configuredTable.Type != ""),
-				SourceColumns:   sourceTables[k].Columns,
-			}
-			if t.PartitionsRegex != nil && *t.PartitionsRegex != "" {
-				re, err := regexp.Compile(*t.PartitionsRegex)
+			for _, configuredTable := range configuredMap.findConfiguredTable(db.ID, k).destinations() {
+				t, err := newMappingEntry(db, k, sourceTables[k], configuredTable)
 				if err != nil {
-					return fmt.Errorf("can't compile partition regex, table:%s, regex:%s", k, *t.PartitionsRegex)
+					return err
 				}
-				t.compiledRegex = re
-			}
-			destName := configuredTable.Target
-			if destName == "" {
-				destName = k
+				result = append(result, t)
 			}
-			d, ok := DestTables[destName]
-			if t.Type != "" || ok {
-				t.Present = true
-				t.DestColumns = d.Columns
-			}
-			env := ConvertPGColumnsToEnv(t.SourceColumns)
-			if t.Filter != "" {
-				t.compiledFilter, err = prepareExpression(t.Filter, env)
-				if err != nil {
-					return fmt.Errorf("can't compile filter: %s, error: %w", t.Filter, err)
-				}
-			}
-			t.compiledSet = make(map[string]cel.Program)
-			for c, p := range t.Set {
-				t.compiledSet[c], err = prepareExpression(p, env)
-				if err != nil {
-					return fmt.Errorf("can't compile Set statement: %s, error: %w", p, err)
-				}
-			}
-			result = append(result, t)
 		}
 	}
 	sort.Sort(result)
 	for i := range result {
 		result[i].ID = int64(i)
 	}
-	MappingTable = result
-	log.Debug("Refreshed mapping table", "MappingTable", MappingTable)
+	setMappingTable(result)
+	log.Debug("Refreshed mapping table", "MappingTable", result)
 	return nil
 }
+
+// newMappingEntry returns the entry replicating a source table to one of its destinations.
+func newMappingEntry(db SourceDatabase, k string, sourceTable PGTable, configuredTable SourceTable) (MappingEntry, error) {
+	var err error
+	schema, table := splitSchema(k)
+	t := MappingEntry{
+		DBId:             db.ID,
+		DBName:           db.Name,
+		Schema:           schema,
+		Name:             table,
+		Type:             configuredTable.Type,
+		Target:           configuredTable.Target,
+		TargetExpression: configuredTable.TargetExpression,
+		Filter:           configuredTable.Filter,
+		Set:              configuredTable.Set,
+		Columns:          configuredTable.Columns,
+		Exclude:          configuredTable.Exclude,
+		Constants:        configuredTable.Constants,
+		Partitions:       sourceTable.Partitions,
+		PartitionsRegex:  &configuredTable.PartitionsRegex,
+		HistoryTime:      configuredTable.HistoryTime,
+		SchemaEvolution:  configuredTable.SchemaEvolution,
+		Replicated:       (configuredTable.Type != ""),
+		SourceColumns:    sourceTable.Columns,
+	}
+	if t.PartitionsRegex != nil && *t.PartitionsRegex != "" {
+		re, err := regexp.Compile(*t.PartitionsRegex)
+		if err != nil {
+			return t, fmt.Errorf("can't compile partition regex, table:%s, regex:%s", k, *t.PartitionsRegex)
+		}
+		t.compiledRegex = re
+	}
+	if t.Type != "" && !slices.Contains(tableTypes, t.Type) {
+		return t, fmt.Errorf("invalid table type, table:%s, type:%s", k, t.Type)
+	}
+	if t.SchemaEvolution != "" && t.SchemaEvolution != SchemaEvolutionAddColumns && t.SchemaEvolution != SchemaEvolutionFull {
+		return t, fmt.Errorf("invalid schema evolution, table:%s, schema_evolution:%s", k, t.SchemaEvolution)
+	}
+	t.history, err = newHistoryOptions(configuredTable)
+	if err != nil {
+		return t, fmt.Errorf("can't configure history, table:%s, error: %w", k, err)
+	}
+	env := ConvertPGColumnsToEnv(t.SourceColumns)
+	if t.TargetExpression != "" || t.Filter != "" || len(t.Set) > 0 {
+		for name := range celMetadata {
+			if _, ok := env[name]; ok {
+				return t, fmt.Errorf("column has the name of an expression variable, table:%s, column:%s", k, name)
+			}
+		}
+	}
+	if t.TargetExpression != "" {
+		t.Present = true
+		t.compiledTarget, err = prepareExpression(t.TargetExpression, env)
+		if err != nil {
+			return t, fmt.Errorf("can't compile target expression: %s, error: %w", t.TargetExpression, err)
+		}
+	} else {
+		destName := configuredTable.Target
+		if destName == "" {
+			destName = k
+		}
+		d, ok := DestTables()[destName]
+		if t.Type != "" || ok {
+			t.Present = true
+			t.DestColumns = d.Columns
+		}
+		checkHistoryTable(t.Type, joinSchema(config.Database.Schema, destName), t.history)
+	}
+	if t.Filter != "" {
+		t.compiledFilter, err = prepareExpression(t.Filter, env)
+		if err != nil {
+			return t, fmt.Errorf("can't compile filter: %s, error: %w", t.Filter, err)
+		}
+	}
+	t.compiledSet = make(map[string]cel.Program)
+	for c, p := range t.Set {
+		t.compiledSet[c], err = prepareExpression(p, env)
+		if err != nil {
+			return t, fmt.Errorf("can't compile Set statement: %s, error: %w", p, err)
+		}
+	}
+	return t, nil
+}
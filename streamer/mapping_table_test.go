@@ -0,0 +1,102 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// mapped is a mapping entry renaming name to full_name, excluding garbage and adding a region constant.
+var mapped = MappingEntry{
+	Columns:   map[string]string{"name": "full_name"},
+	Exclude:   []string{"garbage"},
+	Constants: map[string]any{"region": "eu"},
+}
+
+func TestMapColumns(t *testing.T) {
+	values := map[string]any{"id": 1, "name": "John", "salary": 1000, "garbage": "x"}
+	want := map[string]any{"id": 1, "full_name": "John", "salary": 1000, "region": "eu"}
+	if got := mapped.mapColumns(values); !maps.Equal(got, want) {
+		t.Errorf("mapped values are %v, want %v", got, want)
+	}
+	if _, ok := values["full_name"]; ok {
+		t.Error("source values were modified")
+	}
+
+	// rows without values such as the old values of an update stay empty
+	if got := mapped.mapColumns(nil); got != nil {
+		t.Errorf("nil values mapped to %v", got)
+	}
+
+	// entries without mapping return the values as they are
+	if got := (MappingEntry{}).mapColumns(values); !maps.Equal(got, values) {
+		t.Errorf("unmapped values are %v, want %v", got, values)
+	}
+}
+
+func TestMapRelation(t *testing.T) {
+	rel := PGRelation{RelationName: "t1", Columns: []PGColumn{
+		{Name: "id", PrimaryKey: true},
+		{Name: "name"},
+		{Name: "garbage"},
+	}}
+	got := mapped.mapRelation(rel)
+	names := make([]string, 0, len(got.Columns))
+	for _, c := range got.Columns {
+		names = append(names, c.Name)
+	}
+	if want := []string{"id", "full_name"}; !slices.Equal(names, want) {
+		t.Errorf("mapped relation has columns %v, want %v", names, want)
+	}
+	if !got.Columns[0].PrimaryKey {
+		t.Error("primary key was lost")
+	}
+	if rel.Columns[1].Name != "name" {
+		t.Error("source relation was modified")
+	}
+}
+
+func TestSourceColumn(t *testing.T) {
+	entry := MappingEntry{
+		Columns: map[string]string{"name": "full_name", "login": "name"},
+		Exclude: []string{"garbage"},
+	}
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"id", "id"},
+		{"full_name", "name"},
+		{"name", "login"},
+		{"login", ""},
+		{"garbage", ""},
+	}
+	for _, tt := range tests {
+		if got := entry.sourceColumn(tt.dest); got != tt.want {
+			t.Errorf("source of %s is %q, want %q", tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestMetadataVariableConflict(t *testing.T) {
+	source := PGTable{Columns: map[string]PGColumn{"id": {Name: "id"}, "op": {Name: "op"}}}
+	tests := []struct {
+		name    string
+		table   PGTable
+		filter  string
+		wantErr bool
+	}{
+		{"expression with a column named as a variable", source, "op == 'insert'", true},
+		{"column named as a variable without expression", source, "", false},
+		{"expression without conflict", PGTable{Columns: map[string]PGColumn{"id": {Name: "id"}}}, "op == 'insert'", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newMappingEntry(SourceDatabase{Name: "db1"}, "public.t1", tt.table,
+				SourceTable{Type: TableTypeClone, Filter: tt.filter})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newMappingEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
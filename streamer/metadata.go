@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"log/slog"
 	"math/rand/v2"
+	"slices"
 	"strings"
+	"sync/atomic"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
@@ -15,10 +17,11 @@ import (
 
 type (
 	PGColumn struct {
-		Name        string `json:"name"`
-		ColumnType  string `json:"column_type"`
-		DataTypeOID uint32 `json:"data_type_oid"`
-		PrimaryKey  bool   `json:"primary_key"`
+		Name         string `json:"name"`
+		ColumnType   string `json:"column_type"`
+		DataTypeOID  uint32 `json:"data_type_oid"`
+		TypeModifier int32  `json:"type_modifier"`
+		PrimaryKey   bool   `json:"primary_key"`
 	}
 	PGTable struct {
 		Columns    map[string]PGColumn
@@ -27,9 +30,9 @@ type (
 	PGTables map[string]PGTable
 
 	PGRelation struct {
-		Namespace    string
-		RelationName string
-		Columns      []PGColumn
+		Namespace    string     `json:"namespace"`
+		RelationName string     `json:"relation_name"`
+		Columns      []PGColumn `json:"columns"`
 	}
 	PGRelations map[uint32]PGRelation
 )
@@ -79,6 +82,48 @@ func getPrimaryKey(log *slog.Logger, database *pgx.Conn, tableName string) (map[
 	return result, nil
 }
 
+// destTables holds the current destination metadata, it is replaced as a whole when it is refreshed.
+var destTables atomic.Pointer[PGTables]
+
+// DestTables returns the current destination metadata. It must not be modified.
+func DestTables() PGTables {
+	if t := destTables.Load(); t != nil {
+		return *t
+	}
+	return nil
+}
+
+// setDestTables publishes new destination metadata and releases the statements built from the previous one.
+func setDestTables(tables PGTables) {
+	destTables.Store(&tables)
+	invalidateStatements()
+}
+
+// refreshDestTables reloads the destination metadata after a committed change of the destination
+// and updates the destination columns of the mapping entries.
+func refreshDestTables(ctx context.Context) error {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+	conn, err := DestConnectionPool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("can't acquire connection to fetch metadata: error=%w", err)
+	}
+	defer conn.Release()
+	tables, err := GetTables(log, conn.Conn(), config.Database.Schema)
+	if err != nil {
+		return fmt.Errorf("can't get destination table metadata while refreshing, error=%w", err)
+	}
+	setDestTables(tables)
+	entries := slices.Clone(MappingTable())
+	for i := range entries {
+		if d, ok := tables[entries[i].destTable()]; ok && entries[i].compiledTarget == nil {
+			entries[i].DestColumns = d.Columns
+		}
+	}
+	setMappingTable(entries)
+	return nil
+}
+
 func GetTables(log *slog.Logger, database *pgx.Conn, schemaName string) (PGTables, error) {
 	query := `WITH p as (
 				SELECT inhparent as table, array_agg (inhrelid::pg_catalog.regclass) as partitions
@@ -197,6 +242,13 @@ func SetupDestination() error {
 			}
 		}
 	}
+	beforeClose := pgconfig.BeforeClose
+	pgconfig.BeforeClose = func(conn *pgx.Conn) {
+		forgetConnection(conn)
+		if beforeClose != nil {
+			beforeClose(conn)
+		}
+	}
 	DestConnectionPool, err = pgxpool.NewWithConfig(context.Background(), pgconfig)
 	if err != nil {
 		return fmt.Errorf("can't connect to target database, url=%s, error=%w", config.Database.URL, err)
@@ -212,10 +264,25 @@ func SetupDestination() error {
 
 	// Get destination metadata
 	log.Info("Getting destination table metadata")
-	DestTables, err = GetTables(log, conn.Conn(), config.Database.Schema)
+	tables, err := GetTables(log, conn.Conn(), config.Database.Schema)
 	if err != nil {
 		return fmt.Errorf("can't get destination table metadata during initial setup, error=%w", err)
 	}
+	setDestTables(tables)
+
+	// Create dead letter, sync state and checkpoint tables
+	err = createDeadLetterTable(conn.Conn())
+	if err != nil {
+		return err
+	}
+	err = createSyncStateTable(conn.Conn())
+	if err != nil {
+		return err
+	}
+	err = createCheckpointTable(conn.Conn())
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
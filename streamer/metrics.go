@@ -37,6 +37,12 @@ var (
 			Help: "Total number of bytes synced.",
 		}, []string{"database", "sid", "table"},
 	)
+	syncChunksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streamer_sync_chunks_total",
+			Help: "Total number of table chunks synced.",
+		}, []string{"database", "sid", "table", "result"},
+	)
 	jobsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "streamer_jobs_total",
@@ -44,6 +50,32 @@ var (
 		}, []string{"channel"},
 	)
 
+	deadLettersTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "streamer_dead_letters_total",
+			Help: "Total number of operations moved to the dead letter table.",
+		}, []string{"database", "sid", "table"},
+	)
+
+	lagBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streamer_lag_bytes",
+			Help: "Bytes of WAL between the end of the source WAL and the position committed in the destination.",
+		}, []string{"database", "sid"},
+	)
+	lagSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streamer_lag_seconds",
+			Help: "Age of the oldest source transaction not yet committed in the destination.",
+		}, []string{"database", "sid"},
+	)
+	slotRetainedBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "streamer_slot_retained_bytes",
+			Help: "Bytes of WAL retained on the source by the replication slot.",
+		}, []string{"database", "sid"},
+	)
+
 	urlHeartbeat = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "url_heartbeat",
@@ -0,0 +1,7 @@
+-- +goose Up
+alter table tbl add column history_start text null;
+alter table tbl add column history_end text null;
+alter table tbl add column history_deleted text null;
+alter table tbl add column history_current text null;
+alter table tbl add column history_open_end text null;
+alter table tbl add column history_initial_start text null;
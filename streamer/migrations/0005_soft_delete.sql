@@ -0,0 +1,2 @@
+-- +goose Up
+alter table tbl add column soft_delete_column text null;
@@ -0,0 +1,2 @@
+-- +goose Up
+alter table tbl add column target_expression text null;
@@ -0,0 +1,2 @@
+-- +goose Up
+alter table tbl add column schema_evolution text null;
@@ -0,0 +1,31 @@
+-- +goose Up
+create table tbl_destinations(
+    tbl_id                integer primary key,
+    db_id                 integer not null references db(db_id),
+    schema                text    not null default 'public',
+    name                  text    not null,
+    type                  text    not null,
+    target                text    not null,
+    partitions_regex      text    null,
+    history_time          text    null,
+    history_start         text    null,
+    history_end           text    null,
+    history_deleted       text    null,
+    history_current       text    null,
+    history_open_end      text    null,
+    history_initial_start text    null,
+    history_version       text    null,
+    soft_delete_column    text    null,
+    target_expression     text    null,
+    schema_evolution      text    null
+);
+insert into tbl_destinations(tbl_id, db_id, schema, name, type, target, partitions_regex,
+    history_time, history_start, history_end, history_deleted, history_current, history_open_end,
+    history_initial_start, history_version, soft_delete_column, target_expression, schema_evolution)
+select tbl_id, db_id, schema, name, type, target, partitions_regex,
+    history_time, history_start, history_end, history_deleted, history_current, history_open_end,
+    history_initial_start, history_version, soft_delete_column, target_expression, schema_evolution
+from tbl;
+drop table tbl;
+alter table tbl_destinations rename to tbl;
+create unique index tbl_destination on tbl(db_id, schema, name, target, coalesce(target_expression, ''));
@@ -4,9 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
 type (
@@ -14,12 +18,28 @@ type (
 		Attribute string
 		Value     any
 	}
+
+	// keyColumn is a column identifying a row, a nil value is compared with IS NULL.
+	keyColumn struct {
+		name  string
+		value any
+	}
+
+	// cloneQuery is a statement of a clone operation. Operations with the same key use
+	// the same statement text, which is prepared once on each destination connection.
+	cloneQuery struct {
+		key        string
+		sql        string
+		parameters []any
+	}
 )
 
+// buildSetList adds the values existing in the destination table to the argument list, sorted by column.
 func (op operation) buildSetList(tableName string, args []arg, values map[string]any) ([]arg, error) {
 	i := 0
+	first := len(args)
 	for attribute, value := range values {
-		_, ok := DestTables[tableName].Columns[attribute]
+		_, ok := DestTables()[tableName].Columns[attribute]
 		if !ok {
 			log.Debug("skip non-existing attribute", "attribute", attribute)
 			continue
@@ -32,19 +52,18 @@ func (op operation) buildSetList(tableName string, args []arg, values map[string
 	if i == 0 {
 		return args, errors.New("no attributes were mapped")
 	}
+	sort.Slice(args[first:], func(a, b int) bool { return args[first+a].Attribute < args[first+b].Attribute })
 	return args, nil
 }
 
-func buildWhere(
+// keyColumns returns the columns identifying a row, in the order of the relation.
+func keyColumns(
 	tableName string,
 	relation PGRelation,
 	values map[string]any,
 	oldValues map[string]any,
-	old uint8,
-	query string,
-	queryParameters []any) (string, []any) {
-	j := len(queryParameters) + 1
-
+	old uint8) []keyColumn {
+	keys := make([]keyColumn, 0)
 	switch old {
 	case 'K', 0:
 		for _, column := range relation.Columns {
@@ -52,7 +71,7 @@ func buildWhere(
 				log.Debug("Skip non-primary key component", "column", column)
 				continue
 			}
-			_, ok := DestTables[tableName].Columns[column.Name]
+			_, ok := DestTables()[tableName].Columns[column.Name]
 			if !ok {
 				log.Error("Configuration error: primary key component does not exist in destination table.", "column", column)
 				continue
@@ -71,50 +90,42 @@ func buildWhere(
 				log.Error("Bug: NULL received in primary component", "column", column)
 				continue
 			}
-			query = fmt.Sprintf("%s AND %s=$%d", query, column.Name, j)
-			queryParameters = append(queryParameters, value)
-			j++
+			keys = append(keys, keyColumn{column.Name, value})
 		}
 	case 'O':
 		// no primary key is defined, range over all incoming values skipping non-existing columns
 		for column, value := range oldValues {
-			_, ok := DestTables[tableName].Columns[column]
+			_, ok := DestTables()[tableName].Columns[column]
 			if !ok {
 				log.Error("Configuration error: skip non-existing column with replica-identity-full, tables should be similar",
 					"column", column)
 				continue
 			}
 			log.Debug("Add", "column", column, "value", value)
-			if value == nil {
-				query = fmt.Sprintf("%s AND %s IS NULL", query, column)
-			} else {
-				query = fmt.Sprintf("%s AND %s=$%d", query, column, j)
-				queryParameters = append(queryParameters, value)
-				j++
-			}
+			keys = append(keys, keyColumn{column, value})
 		}
+		sort.Slice(keys, func(a, b int) bool { return keys[a].name < keys[b].name })
 	default:
 		log.Error("Invalid old tuple indicator", "old", old)
 	}
-	return query, queryParameters
+	return keys
 }
 
-func buildTranslatedWhere(
+// translatedKeyColumns returns the columns identifying a translated row, sorted by name.
+func translatedKeyColumns(
 	tableName string,
 	entry MappingEntry,
 	values map[string]any,
 	oldValues map[string]any,
-	old uint8,
-	query string,
-	queryParameters []any) (string, []any) {
+	old uint8) []keyColumn {
 	var value any
 	var ok bool
 
-	j := len(queryParameters) + 1
+	keys := make([]keyColumn, 0)
 	log.Debug("buildTranslatedWhere", "oldValues", oldValues, "old", old, "values", values, "entry", entry)
 	switch old {
 	case 'K', 0:
-		for columnName, column := range DestTables[tableName].Columns {
+		for columnName, column := range DestTables()[tableName].Columns {
 			if !column.PrimaryKey {
 				log.Debug("Skip non-primary key component", "columnName", columnName, "column", column)
 				continue
@@ -132,73 +143,141 @@ func buildTranslatedWhere(
 				log.Error("Bug: NULL received in primary component", "columnName", columnName)
 				continue
 			}
-			query = fmt.Sprintf("%s AND %s=$%d", query, columnName, j)
-			queryParameters = append(queryParameters, value)
-			j++
+			keys = append(keys, keyColumn{columnName, value})
 		}
 	case 'O':
 		// no primary key is defined, range over all incoming values skipping non-existing columns
-		for columnName := range DestTables[tableName].Columns {
+		for columnName := range DestTables()[tableName].Columns {
 			value, ok = oldValues[columnName]
 			if !ok {
 				log.Error("Bug: row component not calculated", "columnName", columnName)
 				continue
 			}
-			if value == nil {
-				query = fmt.Sprintf("%s AND %s IS NULL", query, columnName)
-			} else {
-				query = fmt.Sprintf("%s AND %s=$%d", query, columnName, j)
-				queryParameters = append(queryParameters, value)
-				j++
-			}
+			keys = append(keys, keyColumn{columnName, value})
 		}
 	default:
 		log.Error("Invalid old tuple indicator", "old", old)
 	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a].name < keys[b].name })
+	return keys
+}
+
+// appendWhere adds the key columns of a row to a query, the values are numbered after the existing parameters.
+func appendWhere(query string, keys []keyColumn, queryParameters []any) (string, []any) {
+	for _, k := range keys {
+		if k.value == nil {
+			query = fmt.Sprintf("%s AND %s IS NULL", query, k.name)
+			continue
+		}
+		queryParameters = append(queryParameters, k.value)
+		query = fmt.Sprintf("%s AND %s=$%d", query, k.name, len(queryParameters))
+	}
 	return query, queryParameters
 }
 
-func (op operation) insertClone(tx pgx.Tx) error {
-	var query string
-	var err error
-	log := op.log.With("op", "insertClone", "table", op.destTable)
+// keyShape describes the WHERE clause of key columns, keys with the same shape produce the same clause.
+func keyShape(keys []keyColumn) string {
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k.name)
+		if k.value == nil {
+			b.WriteString(" IS NULL")
+		}
+		b.WriteString(",")
+	}
+	return b.String()
+}
 
-	t0 := time.Now()
-	// Build query
-	columns := ""
-	valuesIndices := ""
-	i := 1
-	queryParameters := make([]any, 0)
+func buildWhere(
+	tableName string,
+	relation PGRelation,
+	values map[string]any,
+	oldValues map[string]any,
+	old uint8,
+	query string,
+	queryParameters []any) (string, []any) {
+	return appendWhere(query, keyColumns(tableName, relation, values, oldValues, old), queryParameters)
+}
+
+func buildTranslatedWhere(
+	tableName string,
+	entry MappingEntry,
+	values map[string]any,
+	oldValues map[string]any,
+	old uint8,
+	query string,
+	queryParameters []any) (string, []any) {
+	return appendWhere(query, translatedKeyColumns(tableName, entry, values, oldValues, old), queryParameters)
+}
+
+// rowKeys returns the key columns of the row of an operation, translated when the entry sets columns.
+func (op operation) rowKeys(values map[string]any, oldValues map[string]any) []keyColumn {
+	entry := MappingTable().FindByID(op.id)
+	if len(entry.compiledSet) == 0 { // straight-through without translation
+		return keyColumns(op.destTable, op.relation, values, oldValues, op.old)
+	}
+	return translatedKeyColumns(op.destTable, entry, values, oldValues, op.old)
+}
+
+// exec runs a clone statement, preparing it on the connection of the transaction on first use.
+func (q cloneQuery) exec(ctx context.Context, tx pgx.Tx) (pgconn.CommandTag, error) {
+	name, err := prepareStatement(ctx, tx, q)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	tag, err := tx.Exec(ctx, name, q.parameters...)
+	if err == nil {
+		trimStatements(ctx, tx.Conn())
+	}
+	return tag, err
+}
+
+// insertCloneQuery builds the statement inserting the row of an operation.
+func (op operation) insertCloneQuery() cloneQuery {
+	columns := op.insertColumns()
+	queryParameters := make([]any, 0, len(columns)+1)
 	if op.destTableHasSID {
-		columns = "sid"
-		valuesIndices = "$1"
-		i++
+		columns = append([]string{"sid"}, columns...)
 		queryParameters = append(queryParameters, op.sid)
 	}
-	for c, v := range op.values {
-		_, ok := DestTables[op.destTable].Columns[c]
-		if !ok {
-			log.Debug("skip non-existing destination column", "column", c)
-			continue
-		}
-		log.Debug("Add", "column", c, "value", v)
-		if columns == "" {
-			columns = c
-			valuesIndices = "$1"
-		} else {
-			columns = fmt.Sprintf("%s, %s", columns, c)
-			valuesIndices = fmt.Sprintf("%s, $%d", valuesIndices, i)
+	for _, c := range columns[len(queryParameters):] {
+		queryParameters = append(queryParameters, op.values[c])
+	}
+	indices := make([]string, len(columns))
+	for i := range columns {
+		indices[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return cloneQuery{
+		key: "ic " + op.destTable + " " + strings.Join(columns, ","),
+		sql: fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s) on conflict do nothing",
+			op.destTable, strings.Join(columns, ", "), strings.Join(indices, ", ")),
+		parameters: queryParameters,
+	}
+}
+
+// insertColumns returns the sorted columns of the row of an insert existing in the destination table.
+func (op operation) insertColumns() []string {
+	columns := make([]string, 0, len(op.values))
+	for c := range op.values {
+		if _, ok := DestTables()[op.destTable].Columns[c]; ok {
+			columns = append(columns, c)
 		}
-		queryParameters = append(queryParameters, v)
-		i++
 	}
-	query = fmt.Sprintf("INSERT INTO %s (%s) VALUES(%s) on conflict do nothing", op.destTable, columns, valuesIndices)
+	sort.Strings(columns)
+	return columns
+}
+
+func (op operation) insertClone(tx pgx.Tx) error {
+	log := op.log.With("op", "insertClone", "table", op.destTable)
+
+	t0 := time.Now()
+	q := op.insertCloneQuery()
 
 	// Run query
-	log.Debug("insert", "query", query, "queryParameters", queryParameters)
-	_, err = tx.Exec(context.Background(), query, queryParameters...)
+	log.Debug("insert", "key", q.key, "queryParameters", q.parameters)
+	_, err := q.exec(context.Background(), tx)
 	if err != nil {
-		log.Error("can't insert", "table", op.destTable, "query", query, "error", err)
+		log.Error("can't insert", "table", op.destTable, "key", q.key, "error", err)
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "failure").Inc()
 		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "failure").Observe(time.Since(t0).Seconds())
 		return fmt.Errorf("insertClone failed, error=%w", err)
@@ -214,12 +293,34 @@ func (op operation) insertClone(tx pgx.Tx) error {
 //  2. PK exists and is updated => old=K, oldValues=oldPK ==> where PK=oldPK and sid=SID.
 //  3. PK does not exist, replica full => old=O, oldValues=alloldValues ==> WHERE allfields=alloldValues.
 func (op operation) updateClone(tx pgx.Tx) error {
-	var i int
-	args := make([]arg, 0)
 	log := op.log.With("op", "updateClone", "table", op.destTable)
 
 	t0 := time.Now()
 	log.Debug("Dump params", "values", op.values, "oldvalues", op.oldValues, "old", op.old)
+	q, err := op.updateCloneQuery()
+	if err != nil {
+		return err
+	}
+
+	// Run query
+	log.Debug("update", "key", q.key, "queryParameters", q.parameters)
+	_, err = q.exec(context.Background(), tx)
+	if err != nil {
+		log.Error("can't update", "table", op.destTable, "key", q.key, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("updateClone failed: error=%w", err)
+	}
+	// requestDuration.WithLabelValues(path, r.Method, code).Observe(float64(duration) / 1000)
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "success").Observe(time.Since(t0).Seconds())
+
+	return nil
+}
+
+// updateCloneQuery builds the statement updating the row of an operation.
+func (op operation) updateCloneQuery() (cloneQuery, error) {
+	args := make([]arg, 0)
 
 	// Build argument list
 	if op.destTableHasSID {
@@ -227,89 +328,134 @@ func (op operation) updateClone(tx pgx.Tx) error {
 	}
 	args, err := op.buildSetList(op.destTable, args, op.values)
 	if err != nil {
-		return err
+		return cloneQuery{}, err
 	}
+	keys := op.rowKeys(op.values, op.oldValues)
 
+	columns := make([]string, 0, len(args))
+	queryParameters := make([]any, 0, len(args)+len(keys)+1)
+	for _, a := range args {
+		columns = append(columns, a.Attribute)
+		queryParameters = append(queryParameters, a.Value)
+	}
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+	}
 	// Start building UPDATE query
-	query := fmt.Sprintf("UPDATE %s SET %s=$1", op.destTable, args[0].Attribute)
-	queryParameters := make([]any, 0)
-	queryParameters = append(queryParameters, args[0].Value)
-	for i = 1; i < len(args); i++ {
-		query = fmt.Sprintf("%s, %s=$%d", query, args[i].Attribute, i+1)
-		queryParameters = append(queryParameters, args[i].Value)
+	set := make([]string, len(columns))
+	for i, c := range columns {
+		set[i] = fmt.Sprintf("%s=$%d", c, i+1)
 	}
+	query := fmt.Sprintf("UPDATE %s SET %s", op.destTable, strings.Join(set, ", "))
 
 	// Add WHERE clause
 	if op.destTableHasSID {
-		query = fmt.Sprintf("%s WHERE sid=$%d", query, i+1)
-		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s WHERE sid=$%d", query, len(queryParameters))
 	} else {
 		query += " WHERE true"
 	}
 
 	// add primary key
-	entry := MappingTable.FindByID(op.id)
-	if len(entry.compiledSet) == 0 { // straight-through without translation
-		query, queryParameters = buildWhere(op.destTable, op.relation, op.values, op.oldValues, op.old, query, queryParameters)
-	} else {
-		query, queryParameters = buildTranslatedWhere(op.destTable, entry, op.values, op.oldValues, op.old, query, queryParameters)
-	}
+	query, queryParameters = appendWhere(query, keys, queryParameters)
+	return cloneQuery{
+		key:        "uc " + op.destTable + " " + strings.Join(columns, ",") + " " + keyShape(keys),
+		sql:        query,
+		parameters: queryParameters,
+	}, nil
+}
 
-	// Run query
-	log.Debug("update", "query", query, "queryParameters", queryParameters)
-	_, err = tx.Exec(context.Background(), query, queryParameters...)
-	if err != nil {
-		log.Error("can't update", "table", op.destTable, "query", query, "error", err)
-		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Inc()
-		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Observe(time.Since(t0).Seconds())
-		return fmt.Errorf("updateClone failed: error=%w", err)
-	}
-	// requestDuration.WithLabelValues(path, r.Method, code).Observe(float64(duration) / 1000)
-	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "success").Inc()
-	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "success").Observe(time.Since(t0).Seconds())
+// deleteWhere adds the primary key of a deleted row to a query.
+// Deletes only receive the old values of the row.
+func (op operation) deleteWhere(query string, queryParameters []any) (string, []any) {
+	return appendWhere(query, op.rowKeys(nil, op.values), queryParameters)
+}
 
-	return nil
+// deleteCloneQuery builds the statement deleting the row of an operation.
+func (op operation) deleteCloneQuery() cloneQuery {
+	keys := op.rowKeys(nil, op.values)
+	queryParameters := make([]any, 0, len(keys)+1)
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE true ", op.destTable)
+	if op.destTableHasSID {
+		query = fmt.Sprintf("DELETE FROM %s WHERE sid=$1 ", op.destTable)
+	}
+	query, queryParameters = appendWhere(query, keys, queryParameters)
+	return cloneQuery{
+		key:        "dc " + op.destTable + " " + keyShape(keys),
+		sql:        query,
+		parameters: queryParameters,
+	}
 }
 
 func (op operation) deleteClone(tx pgx.Tx) error {
-	var query string
 	log := op.log.With("op", "deleteClone", "table", op.destTable)
 
 	t0 := time.Now()
 	log.Debug("Dump params", "op", op)
-	queryParameters := make([]any, 0)
-
-	// Build query
-	if op.destTableHasSID {
-		query = fmt.Sprintf("DELETE FROM %s WHERE sid=$1 ", op.destTable)
-		queryParameters = append(queryParameters, op.sid)
-	} else {
-		query = fmt.Sprintf("DELETE FROM %s WHERE true ", op.destTable)
-	}
-
-	entry := MappingTable.FindByID(op.id)
-	if len(entry.compiledSet) == 0 { // straight-through without translation
-		query, queryParameters = buildWhere(op.destTable, op.relation, nil, op.values, op.old, query, queryParameters)
-	} else {
-		query, queryParameters = buildTranslatedWhere(op.destTable, entry, nil, op.values, op.old, query, queryParameters)
-	}
+	q := op.deleteCloneQuery()
 
 	// Run query
-	log.Debug("delete", "query", query, "parameters", queryParameters)
-	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	log.Debug("delete", "key", q.key, "parameters", q.parameters)
+	rows, err := q.exec(context.Background(), tx)
 	if err != nil {
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
 		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Observe(time.Since(t0).Seconds())
-		log.Error("can't delete", "table", op.destTable, "query", query, "error", err)
+		log.Error("can't delete", "table", op.destTable, "key", q.key, "error", err)
 		return fmt.Errorf("deleteClone failed: error=%w", err)
 	}
 	if rows.RowsAffected() == 0 {
-		log.Error("did not find row to delete, destination database was not in sync", "query", query, "parameters", queryParameters)
+		log.Error("did not find row to delete, destination database was not in sync", "key", q.key, "parameters", q.parameters)
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
 		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Observe(time.Since(t0).Seconds())
-		return errors.New("deleteClone failed: no affected rows")
+		return fmt.Errorf("deleteClone failed: %w", errNoAffectedRows)
 	}
 	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "success").Inc()
 	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "success").Observe(time.Since(t0).Seconds())
 	return nil
 }
+
+// truncateClone removes all rows received from the source.
+// When the destination table is shared between sources, only the rows of the source are deleted
+// as TRUNCATE would remove the rows of the other sources.
+func (op operation) truncateClone(tx pgx.Tx) error {
+	var query string
+	log := op.log.With("op", "truncateClone", "table", op.destTable)
+
+	t0 := time.Now()
+	queryParameters := make([]any, 0)
+
+	// Build query
+	if op.destTableHasSID {
+		query = fmt.Sprintf("DELETE FROM %s WHERE sid=$1", op.destTable)
+		queryParameters = append(queryParameters, op.sid)
+		if op.truncateOption&pglogrepl.TruncateOptionRestartIdentity != 0 {
+			log.Warn("RESTART IDENTITY ignored, destination table is shared between sources")
+		}
+		if op.truncateOption&pglogrepl.TruncateOptionCascade != 0 {
+			log.Warn("CASCADE ignored, destination table is shared between sources")
+		}
+	} else {
+		query = "TRUNCATE " + op.destTable
+		if op.truncateOption&pglogrepl.TruncateOptionRestartIdentity != 0 {
+			query += " RESTART IDENTITY"
+		}
+		if op.truncateOption&pglogrepl.TruncateOptionCascade != 0 {
+			query += " CASCADE"
+		}
+	}
+
+	// Run query
+	log.Debug("truncate", "query", query, "parameters", queryParameters)
+	_, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		log.Error("can't truncate", "table", op.destTable, "query", query, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("truncateClone failed: error=%w", err)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "success").Observe(time.Since(t0).Seconds())
+	return nil
+}
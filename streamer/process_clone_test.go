@@ -0,0 +1,41 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestKeyShape(t *testing.T) {
+	tests := []struct {
+		keys []keyColumn
+		want string
+	}{
+		{nil, ""},
+		{[]keyColumn{{"id", 1}}, "id,"},
+		{[]keyColumn{{"id", 1}, {"name", "x"}}, "id,name,"},
+		{[]keyColumn{{"id", 1}, {"name", nil}}, "id,name IS NULL,"},
+	}
+	for _, tt := range tests {
+		if got := keyShape(tt.keys); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.keys, got, tt.want)
+		}
+	}
+
+	// keys with the same shape produce the same clause with other values
+	a, _ := appendWhere("", []keyColumn{{"id", 1}, {"name", nil}}, nil)
+	b, _ := appendWhere("", []keyColumn{{"id", 2}, {"name", nil}}, nil)
+	c, _ := appendWhere("", []keyColumn{{"id", 2}, {"name", "x"}}, nil)
+	if a != b || a == c {
+		t.Errorf("clauses %q, %q and %q do not follow the key shapes", a, b, c)
+	}
+}
+
+func TestAppendWhere(t *testing.T) {
+	query, parameters := appendWhere("UPDATE t1 SET name=$1 WHERE sid=$2", []keyColumn{{"id", 1}, {"name", nil}, {"code", "a"}}, []any{"x", "12"})
+	if want := "UPDATE t1 SET name=$1 WHERE sid=$2 AND id=$3 AND name IS NULL AND code=$4"; query != want {
+		t.Errorf("got %q, want %q", query, want)
+	}
+	if want := []any{"x", "12", 1, "a"}; !slices.Equal(parameters, want) {
+		t.Errorf("got parameters %v, want %v", parameters, want)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// eventColumnsDDL defines the columns of an events table.
+const eventColumnsDDL = `id bigserial primary key,
+	sid text not null,
+	source_table text not null,
+	operation text not null,
+	before jsonb,
+	after jsonb,
+	lsn pg_lsn not null,
+	xid bigint not null,
+	commit_time timestamptz`
+
+// jsonImage returns a row image stored in a jsonb column, NULL when it was not received.
+func jsonImage(values map[string]any) any {
+	if values == nil {
+		return nil
+	}
+	return values
+}
+
+// insertEvent appends a change of the source to an events table.
+// Deletes only receive the before image and inserts the after image.
+// Updates receive the before image only with replica identity full or when the key is changed.
+func (op operation) insertEvent(tx pgx.Tx, operation string) error {
+	var before, after map[string]any
+	log := op.log.With("op", "insertEvent", "table", op.destTable)
+
+	t0 := time.Now()
+	switch operation {
+	case "insert":
+		after = op.values
+	case "update":
+		before, after = op.oldValues, op.values
+	case "delete":
+		before = op.values
+	}
+	var commitTime any
+	if !op.commitTime.IsZero() {
+		commitTime = op.commitTime
+	}
+
+	// Build query
+	query := fmt.Sprintf(`INSERT INTO %s (sid, source_table, operation, before, after, lsn, xid, commit_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, op.destTable)
+	queryParameters := []any{op.sid, op.sourceTable, operation, jsonImage(before), jsonImage(after),
+		op.lsn.String(), int64(op.xid), commitTime}
+
+	// Run query
+	log.Debug("insert", "query", query, "queryParameters", queryParameters)
+	_, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		log.Error("can't insert event", "table", op.destTable, "query", query, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, operation, "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, operation, "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("insertEvent failed, error=%w", err)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, operation, "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, operation, "success").Observe(time.Since(t0).Seconds())
+	return nil
+}
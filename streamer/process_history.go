@@ -4,21 +4,231 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// times used as the validity boundaries of versions in history tables.
+	HistoryTimeCommit = "commit"
+	HistoryTimeApply  = "apply"
+
+	// default columns and sentinel values of history tables.
+	defaultHistoryStart        = "kvsz_start"
+	defaultHistoryEnd          = "kvsz_end"
+	defaultHistoryDeleted      = "kvsz_deleted"
+	defaultHistoryCurrent      = "is_current"
+	defaultHistoryVersion      = "version"
+	defaultHistoryOpenEnd      = "9999-01-01"
+	defaultHistoryInitialStart = "1900-01-01"
 )
 
-func (op operation) insertHistory(tableName string, startTime time.Time, values map[string]any) error {
+// historyOptions describes how the versions of a row are recorded in a history table.
+// Sentinel values are nil when they are NULL.
+type historyOptions struct {
+	time         string
+	start        string
+	end          string
+	deleted      string
+	current      string
+	version      string
+	openEnd      any
+	initialStart any
+}
+
+// parseHistorySentinel validates a sentinel timestamp. The string null is the NULL value.
+func parseHistorySentinel(value string, defaultValue string) (any, error) {
+	if value == "" {
+		value = defaultValue
+	}
+	if strings.EqualFold(value, "null") {
+		return nil, nil //nolint:nilnil // NULL sentinel
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if _, err := time.Parse(layout, value); err == nil {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid timestamp: %s", value)
+}
+
+// newHistoryOptions returns the history options of a configured table, using defaults for missing values.
+// The deleted flag is only recorded with a current flag when it is configured explicitly.
+// history6 tables always have a current flag and a version counter.
+// softdelete tables use the deleted column to mark deleted rows.
+func newHistoryOptions(t SourceTable) (historyOptions, error) {
+	var err error
+	h := historyOptions{
+		time:    t.HistoryTime,
+		start:   t.HistoryStart,
+		end:     t.HistoryEnd,
+		deleted: t.HistoryDeleted,
+		current: t.HistoryCurrent,
+		version: t.HistoryVersion,
+	}
+	if t.Type == TableTypeHistory6 {
+		if h.current == "" {
+			h.current = defaultHistoryCurrent
+		}
+		if h.version == "" {
+			h.version = defaultHistoryVersion
+		}
+	}
+	if h.time != "" && h.time != HistoryTimeCommit && h.time != HistoryTimeApply {
+		return h, fmt.Errorf("invalid history time: %s", h.time)
+	}
+	if h.start == "" {
+		h.start = defaultHistoryStart
+	}
+	if h.end == "" {
+		h.end = defaultHistoryEnd
+	}
+	if t.Type == TableTypeSoftDelete && t.SoftDeleteColumn != "" {
+		h.deleted = t.SoftDeleteColumn
+	}
+	if h.deleted == "" && h.current == "" {
+		h.deleted = defaultHistoryDeleted
+	}
+	h.openEnd, err = parseHistorySentinel(t.HistoryOpenEnd, defaultHistoryOpenEnd)
+	if err != nil {
+		return h, fmt.Errorf("invalid history open end, error=%w", err)
+	}
+	h.initialStart, err = parseHistorySentinel(t.HistoryInitialStart, defaultHistoryInitialStart)
+	if err != nil {
+		return h, fmt.Errorf("invalid history initial start, error=%w", err)
+	}
+	return h, nil
+}
+
+// checkHistoryTable logs the history columns and tables missing in the destination database.
+func checkHistoryTable(tableType string, destTable string, h historyOptions) {
+	d, ok := DestTables()[destTable]
+	if !ok {
+		return
+	}
+	switch tableType {
+	case TableTypeHistory, TableTypeHistory6:
+		for _, c := range []string{h.start, h.end, h.deleted, h.current, h.version} {
+			if _, found := d.Columns[c]; c != "" && !found {
+				log.Error("History column does not exist in destination table", "table", destTable, "column", c)
+			}
+		}
+	case TableTypeHistory4:
+		if _, found := DestTables()[historyTableName(destTable)]; !found {
+			log.Error("History table does not exist in destination database", "table", historyTableName(destTable))
+		}
+	case TableTypeSoftDelete:
+		if _, found := d.Columns[h.deleted]; !found {
+			log.Error("Soft delete column does not exist in destination table", "table", destTable, "column", h.deleted)
+		}
+	}
+}
+
+// sentinelDDL returns the definition of a history column defaulting to a sentinel value.
+func sentinelDDL(column string, value any) string {
+	if value == nil {
+		return fmt.Sprintf(", %s timestamptz", column)
+	}
+	return fmt.Sprintf(", %s timestamptz not null default '%s'", column, value)
+}
+
+// startDDL returns the definition of the start column of the current table of a history4 table.
+func (h historyOptions) startDDL() string {
+	return sentinelDDL(h.start, h.initialStart)
+}
+
+// columnsDDL returns the definitions of the history columns added to a destination table.
+// Tables holding only prior versions have no current flag or version.
+func (h historyOptions) columnsDDL(current bool) string {
+	ddl := h.startDDL()
+	if current {
+		ddl += sentinelDDL(h.end, h.openEnd)
+	} else {
+		ddl += fmt.Sprintf(", %s timestamptz not null", h.end)
+	}
+	if h.deleted != "" {
+		ddl += fmt.Sprintf(", %s boolean not null default false", h.deleted)
+	}
+	if current && h.current != "" {
+		ddl += fmt.Sprintf(", %s boolean not null default true", h.current)
+	}
+	if current && h.version != "" {
+		ddl += fmt.Sprintf(", %s integer not null default 1", h.version)
+	}
+	return ddl
+}
+
+// isColumn returns true if the column is maintained by the streamer.
+func (h historyOptions) isColumn(column string) bool {
+	return column == h.start || column == h.end || column == h.deleted || column == h.current || column == h.version
+}
+
+// currentVersion adds the condition selecting the current versions of rows to a query.
+func (h historyOptions) currentVersion(query string, queryParameters []any) (string, []any) {
+	if h.openEnd == nil {
+		return fmt.Sprintf("%s AND %s IS NULL", query, h.end), queryParameters
+	}
+	queryParameters = append(queryParameters, h.openEnd)
+	return fmt.Sprintf("%s AND %s=$%d", query, h.end, len(queryParameters)), queryParameters
+}
+
+// closeVersion returns the update of the current versions of rows valid until the given time.
+// The sid and current version conditions are included, further conditions can be appended.
+func (op operation) closeVersion(t0 time.Time, deleted bool) (string, []any) {
+	h := op.history
+	queryParameters := []any{t0}
+	query := fmt.Sprintf("UPDATE %s SET %s=$1", op.destTable, h.end)
+	if h.deleted != "" && deleted {
+		query = fmt.Sprintf("%s, %s=true", query, h.deleted)
+	}
+	if h.current != "" {
+		query = fmt.Sprintf("%s, %s=false", query, h.current)
+	}
+	query += " WHERE true"
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s AND sid=$%d", query, len(queryParameters))
+	}
+	return h.currentVersion(query, queryParameters)
+}
+
+// validTime returns the time at which a change becomes valid in a history table.
+// It is the commit time of the source transaction unless the table is configured to use the apply time.
+func (op operation) validTime() time.Time {
+	if op.history.time == HistoryTimeApply || op.commitTime.IsZero() {
+		return time.Now()
+	}
+	return op.commitTime
+}
+
+// insertHistory inserts the first version of a row, valid since the beginning of time.
+func (op operation) insertHistory(tx pgx.Tx) error {
+	return op.insertVersion(tx, op.destTable, op.history.initialStart, 1, op.values)
+}
+
+func (op operation) insertVersion(tx pgx.Tx, tableName string, startTime any, version int64, values map[string]any) error {
 	var query string
 	args := make([]arg, 0)
-	log := log.With("op", "insertHistory", "table", tableName)
+	h := op.history
+	log := op.log.With("op", "insertHistory", "table", tableName)
 
 	// Build argument list
 	if op.destTableHasSID {
 		args = append(args, arg{"sid", op.sid})
 	}
-	args = append(args, arg{"kvsz_start", startTime})
-	args = append(args, arg{"kvsz_end", "9999-01-01 00:00:00"})
-	args = append(args, arg{"kvsz_deleted", false})
+	args = append(args, arg{h.start, startTime})
+	args = append(args, arg{h.end, h.openEnd})
+	if h.deleted != "" {
+		args = append(args, arg{h.deleted, false})
+	}
+	if h.current != "" {
+		args = append(args, arg{h.current, true})
+	}
+	if h.version != "" {
+		args = append(args, arg{h.version, version})
+	}
 	args, err := op.buildSetList(tableName, args, values)
 	if err != nil {
 		return err
@@ -39,7 +249,7 @@ func (op operation) insertHistory(tableName string, startTime time.Time, values
 
 	// Run query
 	log.Debug("insert", "query", query)
-	_, err = DestConnectionPool.Exec(context.Background(), query, queryParameters...)
+	_, err = tx.Exec(context.Background(), query, queryParameters...)
 	if err != nil {
 		log.Error("can't insert", "query", query, "error", err)
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "failure").Inc()
@@ -49,66 +259,98 @@ func (op operation) insertHistory(tableName string, startTime time.Time, values
 	return nil
 }
 
+// updateHistory closes the current version of a row and inserts the new version.
+// Both statements run in the same transaction so that a row always has a current version.
+//
 // Cases
 // 1. PK exists and is not updated => old = 0, oldValues=nil ==> where PK=PK and sid=SID.
 // 2. PK exists and is updated => old=K, oldValues=oldPK ==> where PK=oldPK and sid=SID.
 // 3. PK does not exist, replica full => old=O, oldValues=alloldValues ==> where allfields=alloldValues.
-func (op operation) updateHistory(tableName string, relation PGRelation, values map[string]any, old uint8, oldValues map[string]any) error {
-	var i = 1
+func (op operation) updateHistory(tx pgx.Tx) error {
+	tableName := op.destTable
 	log := op.log.With("op", "updateHistory", "table", tableName)
 
-	t0 := time.Now()
+	t0 := op.validTime()
 
-	log.Debug("Dump params", "values", values, "oldvalues", oldValues, "old", old)
+	log.Debug("Dump params", "values", op.values, "oldvalues", op.oldValues, "old", op.old)
 
-	// Update old record with kvsz_end=now
-	query := fmt.Sprintf("UPDATE %s SET kvsz_end=$1", tableName)
-	queryParameters := make([]any, 0)
-	queryParameters = append(queryParameters, t0)
-	i++
+	// A version started by the same source transaction is replaced rather than closed
+	replaced, err := op.replaceVersion(tx, t0)
+	if err != nil || replaced {
+		return err
+	}
 
-	// Add WHERE clause
-	if op.destTableHasSID {
-		query = fmt.Sprintf("%s WHERE sid=$%d AND kvsz_end='9999-01-01'", query, i)
-		queryParameters = append(queryParameters, op.sid)
+	// Update old record with end=validTime
+	query, queryParameters := op.closeVersion(t0, false)
+	query, queryParameters = appendWhere(query, op.rowKeys(op.values, op.oldValues), queryParameters)
+
+	// Run query, the new version follows the closed one
+	var version int64
+	log.Debug("update", "query", query, "args", queryParameters)
+	if op.history.version != "" {
+		query += " RETURNING " + op.history.version
+		err := tx.QueryRow(context.Background(), query, queryParameters...).Scan(&version)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Error("can't update", "query", query, "error", err)
+			requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Inc()
+			return fmt.Errorf("updateHistory failed: error=%w", err)
+		}
 	} else {
-		query += " WHERE kvsz_end='9999-01-01'"
+		_, err := tx.Exec(context.Background(), query, queryParameters...)
+		if err != nil {
+			log.Error("can't update", "query", query, "error", err)
+			requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Inc()
+			return fmt.Errorf("updateHistory failed: error=%w", err)
+		}
 	}
-	query, queryParameters = buildWhere(tableName, relation, nil, values, old, query, queryParameters)
+	return op.insertVersion(tx, tableName, t0, version+1, op.values)
+}
+
+// replaceVersion updates in place the current version of a row when it is valid since the given time.
+// Several changes of a row in the same source transaction share its commit time and would otherwise
+// leave versions valid for no time at all.
+func (op operation) replaceVersion(tx pgx.Tx, t0 time.Time) (bool, error) {
+	if !t0.Equal(op.commitTime) { // versions started at the apply time never collide
+		return false, nil
+	}
+	log := op.log.With("op", "replaceVersion", "table", op.destTable)
+	q, err := op.updateCloneQuery()
+	if err != nil {
+		return false, err
+	}
+	queryParameters := append(q.parameters, t0)
+	query := fmt.Sprintf("%s AND %s=$%d", q.sql, op.history.start, len(queryParameters))
+	query, queryParameters = op.history.currentVersion(query, queryParameters)
 
 	// Run query
-	log.Debug("update", "query", query, "args", queryParameters)
-	_, err := DestConnectionPool.Exec(context.Background(), query, queryParameters...)
+	log.Debug("replace", "query", query, "queryParameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
 	if err != nil {
-		log.Error("can't update", "query", query, "error", err)
+		log.Error("can't replace", "query", query, "error", err)
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "failure").Inc()
-		return fmt.Errorf("updateHistory failed: error=%w", err)
+		return false, fmt.Errorf("replaceVersion failed: error=%w", err)
+	}
+	if rows.RowsAffected() == 0 {
+		return false, nil
 	}
-	err = op.insertHistory(tableName, t0, values)
-	return err
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "update", "success").Inc()
+	return true, nil
 }
 
-func (op operation) deleteHistory(tableName string, relation PGRelation, values map[string]any, old uint8) error {
-	var query string
-	log := log.With("op", "deleteHistory", "table", tableName)
-	t0 := time.Now()
+// deleteHistory closes the current version of a row and marks it as deleted.
+func (op operation) deleteHistory(tx pgx.Tx) error {
+	tableName := op.destTable
+	log := op.log.With("op", "deleteHistory", "table", tableName)
+	t0 := op.validTime()
 
 	// Build query
-	queryParameters := make([]any, 0)
-	if op.destTableHasSID {
-		query = fmt.Sprintf("UPDATE %s set kvsz_deleted=true, kvsz_end=$2 WHERE sid=$1 AND kvsz_end='9999-01-01' ", tableName)
-		queryParameters = append(queryParameters, op.sid)
-	} else {
-		query = fmt.Sprintf("UPDATE %s set kvsz_deleted=true, kvsz_end=$1 WHERE kvsz_end='9999-01-01' ", tableName)
-	}
-	queryParameters = append(queryParameters, t0)
-
-	query, queryParameters = buildWhere(tableName, relation, nil, values, old, query, queryParameters)
+	query, queryParameters := op.closeVersion(t0, true)
+	query, queryParameters = op.deleteWhere(query, queryParameters)
 	// Run query
 	log.Debug("delete",
 		"query", query,
 		"queryParameters", queryParameters)
-	rows, err := DestConnectionPool.Exec(context.Background(), query, queryParameters...)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
 	if err != nil {
 		log.Error("can't update history table",
 			"query", query,
@@ -122,9 +364,30 @@ func (op operation) deleteHistory(tableName string, relation PGRelation, values
 			"query", query,
 			"queryParameters", queryParameters)
 		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
-		return errors.New("deleteHistory failed: no affected rows")
+		return fmt.Errorf("deleteHistory failed: %w", errNoAffectedRows)
 	}
 	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "success").Inc()
 	log.Debug("delete", "RowsAffected", rows.RowsAffected())
 	return nil
 }
+
+// truncateHistory closes all current versions received from the source and marks them as deleted.
+func (op operation) truncateHistory(tx pgx.Tx) error {
+	log := op.log.With("op", "truncateHistory", "table", op.destTable)
+	t0 := op.validTime()
+
+	// Build query
+	query, queryParameters := op.closeVersion(t0, true)
+
+	// Run query
+	log.Debug("truncate", "query", query, "queryParameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		log.Error("can't update history table", "query", query, "queryParameters", queryParameters, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "failure").Inc()
+		return fmt.Errorf("truncateHistory failed: error=%w", err)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "success").Inc()
+	log.Debug("truncate", "RowsAffected", rows.RowsAffected())
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// historyTableName returns the table receiving the prior versions of the rows of a history4 table.
+func historyTableName(destTable string) string {
+	return destTable + "_history"
+}
+
+// archiveVersion copies the current version of rows of a history4 table to its history table
+// before it is updated or deleted. The copies are valid until the change time.
+func (op operation) archiveVersion(tx pgx.Tx, deleted bool, where bool) error {
+	h := op.history
+	historyTable := historyTableName(op.destTable)
+	log := op.log.With("op", "archiveVersion", "table", historyTable)
+
+	started := time.Now()
+	// Columns common to the current and history tables
+	columns := make([]string, 0)
+	for c := range DestTables()[historyTable].Columns {
+		if c == "sid" || h.isColumn(c) {
+			continue
+		}
+		if _, ok := DestTables()[op.destTable].Columns[c]; ok {
+			columns = append(columns, c)
+		}
+	}
+	sort.Strings(columns)
+	if len(columns) == 0 {
+		return fmt.Errorf("archiveVersion failed: no common columns between %s and %s", op.destTable, historyTable)
+	}
+
+	// Build query
+	attributes := strings.Join(columns, ", ")
+	selected := attributes
+	queryParameters := []any{op.validTime()}
+	if op.destTableHasSID {
+		attributes = "sid, " + attributes
+		selected = "sid, " + selected
+	}
+	if _, ok := DestTables()[historyTable].Columns[h.start]; ok {
+		// the start of the archived version is the start of the current one, if known
+		if _, ok := DestTables()[op.destTable].Columns[h.start]; ok {
+			attributes = fmt.Sprintf("%s, %s", attributes, h.start)
+			selected = fmt.Sprintf("%s, %s", selected, h.start)
+		}
+	}
+	attributes = fmt.Sprintf("%s, %s", attributes, h.end)
+	selected += ", $1"
+	if h.deleted != "" {
+		attributes = fmt.Sprintf("%s, %s", attributes, h.deleted)
+		selected = fmt.Sprintf("%s, %t", selected, deleted)
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s WHERE true", historyTable, attributes, selected, op.destTable)
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s AND sid=$%d", query, len(queryParameters))
+	}
+	if where {
+		// deletes only receive the old values
+		values, oldValues := op.values, op.oldValues
+		if deleted {
+			values, oldValues = nil, op.values
+		}
+		entry := MappingTable().FindByID(op.id)
+		if len(entry.compiledSet) == 0 { // straight-through without translation
+			query, queryParameters = buildWhere(op.destTable, op.relation, values, oldValues, op.old, query, queryParameters)
+		} else {
+			query, queryParameters = buildTranslatedWhere(op.destTable, entry, values, oldValues, op.old, query, queryParameters)
+		}
+	}
+
+	// Run query
+	log.Debug("archive", "query", query, "queryParameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		log.Error("can't archive", "query", query, "error", err)
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "archive", "failure").Observe(time.Since(started).Seconds())
+		return fmt.Errorf("archiveVersion failed: error=%w", err)
+	}
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "archive", "success").Observe(time.Since(started).Seconds())
+	log.Debug("archive", "RowsAffected", rows.RowsAffected())
+	return nil
+}
+
+// updateHistory4 archives the current version of a row and updates it.
+// The current version starts at the change time when the destination table has a start column.
+func (op operation) updateHistory4(tx pgx.Tx) error {
+	if err := op.archiveVersion(tx, false, true); err != nil {
+		return err
+	}
+	if _, ok := DestTables()[op.destTable].Columns[op.history.start]; ok {
+		op.values = maps.Clone(op.values)
+		op.values[op.history.start] = op.validTime()
+	}
+	return op.updateClone(tx)
+}
+
+// deleteHistory4 archives the current version of a row as deleted and removes it.
+func (op operation) deleteHistory4(tx pgx.Tx) error {
+	if err := op.archiveVersion(tx, true, true); err != nil {
+		return err
+	}
+	return op.deleteClone(tx)
+}
+
+// truncateHistory4 archives all current rows received from the source as deleted and removes them.
+func (op operation) truncateHistory4(tx pgx.Tx) error {
+	if err := op.archiveVersion(tx, true, false); err != nil {
+		return err
+	}
+	return op.truncateClone(tx)
+}
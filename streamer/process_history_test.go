@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseHistorySentinel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  any
+		valid bool
+	}{
+		{"", defaultHistoryOpenEnd, true},
+		{"null", nil, true},
+		{"NULL", nil, true},
+		{"2100-12-31", "2100-12-31", true},
+		{"2100-12-31 23:59:59", "2100-12-31 23:59:59", true},
+		{"2100-12-31T23:59:59Z", "2100-12-31T23:59:59Z", true},
+		{"infinity", nil, false},
+		{"2100-13-01", nil, false},
+		{"'); drop table t1; --", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseHistorySentinel(tt.value, defaultHistoryOpenEnd)
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: got error=%v, want valid=%t", tt.value, err, tt.valid)
+			continue
+		}
+		if tt.valid && got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestNewHistoryOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		table SourceTable
+		want  historyOptions
+	}{
+		{
+			"history",
+			SourceTable{Type: TableTypeHistory},
+			historyOptions{start: "kvsz_start", end: "kvsz_end", deleted: "kvsz_deleted", openEnd: "9999-01-01", initialStart: "1900-01-01"},
+		},
+		{
+			"history6",
+			SourceTable{Type: TableTypeHistory6},
+			historyOptions{start: "kvsz_start", end: "kvsz_end", current: "is_current", version: "version", openEnd: "9999-01-01", initialStart: "1900-01-01"},
+		},
+		{
+			"configured",
+			SourceTable{
+				Type: TableTypeHistory, HistoryTime: HistoryTimeApply, HistoryStart: "valid_from", HistoryEnd: "valid_to",
+				HistoryCurrent: "current", HistoryDeleted: "deleted", HistoryOpenEnd: "null", HistoryInitialStart: "2000-01-01",
+			},
+			historyOptions{
+				time: HistoryTimeApply, start: "valid_from", end: "valid_to", current: "current", deleted: "deleted",
+				openEnd: nil, initialStart: "2000-01-01",
+			},
+		},
+		{
+			"softdelete",
+			SourceTable{Type: TableTypeSoftDelete, SoftDeleteColumn: "deleted_at"},
+			historyOptions{start: "kvsz_start", end: "kvsz_end", deleted: "deleted_at", openEnd: "9999-01-01", initialStart: "1900-01-01"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := newHistoryOptions(tt.table)
+		if err != nil {
+			t.Errorf("%s: error=%v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, table := range []SourceTable{
+		{Type: TableTypeHistory, HistoryTime: "now"},
+		{Type: TableTypeHistory, HistoryOpenEnd: "forever"},
+		{Type: TableTypeHistory, HistoryInitialStart: "1900"},
+	} {
+		if _, err := newHistoryOptions(table); err == nil {
+			t.Errorf("%+v: invalid options accepted", table)
+		}
+	}
+}
+
+func TestHistoryColumnsDDL(t *testing.T) {
+	h, err := newHistoryOptions(SourceTable{Type: TableTypeHistory6, HistoryOpenEnd: "null"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ", kvsz_start timestamptz not null default '1900-01-01', kvsz_end timestamptz" +
+		", is_current boolean not null default true, version integer not null default 1"
+	if got := h.columnsDDL(true); got != want {
+		t.Errorf("current table columns are %q, want %q", got, want)
+	}
+
+	h, err = newHistoryOptions(SourceTable{Type: TableTypeHistory4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ", kvsz_start timestamptz not null default '1900-01-01', kvsz_end timestamptz not null, kvsz_deleted boolean not null default false"
+	if got := h.columnsDDL(false); got != want {
+		t.Errorf("history table columns are %q, want %q", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log/slog"
+	"maps"
 	"reflect"
 	"time"
 
@@ -19,6 +20,7 @@ type (
 		sid             string
 		opCode          string
 		sourceTable     string
+		syncTable       string
 		destTable       string
 		destTableHasSID bool
 		id              int64
@@ -27,9 +29,39 @@ type (
 		old             uint8
 		oldValues       map[string]any
 		lsn             pglogrepl.LSN
+		truncateOption  uint8
+		commitTime      time.Time
+		xid             uint32
+		history         historyOptions
+		statement       string
+		batch           []operation
+		done            chan error
 	}
 )
 
+// opCodeFor returns the operation code applying an insert (i), update (u), delete (d) or truncate (t)
+// of a source table to a destination table of the given type.
+func opCodeFor(tableType string, action string) string {
+	switch tableType {
+	case TableTypeHistory, TableTypeHistory6:
+		return action + "h"
+	case TableTypeHistory4:
+		if action == "i" {
+			return "ic"
+		}
+		return action + "4"
+	case TableTypeSoftDelete:
+		if action == "u" {
+			return "uc"
+		}
+		return action + "s"
+	case TableTypeEvents:
+		return action + "e"
+	default:
+		return action + "c"
+	}
+}
+
 func decodeTextColumnData(mi *pgtype.Map, data []byte, dataType uint32) (any, error) {
 	if dt, ok := mi.TypeForOID(dataType); ok {
 		log.Debug("found", "data", string(data), "dt", dt)
@@ -93,26 +125,34 @@ func getEnv(rel PGRelation, columns []*pglogrepl.TupleDataColumn, typeMap *pgtyp
 			// This TOAST value was not changed. TOAST values are not stored in the tuple,
 			// and logical replication doesn't want to spend a disk read to fetch its value for you.
 		case 't': // text
-			if rel.Columns[idx].DataTypeOID == 2950 { // uuid
-				values[colName] = string(col.Data)
-				continue
-			}
-			if dt, ok := typeMap.TypeForOID(rel.Columns[idx].DataTypeOID); ok {
-				log.Debug("found", "data", string(col.Data), "dt", dt)
-				decodedColumn, err := dt.Codec.DecodeValue(typeMap, rel.Columns[idx].DataTypeOID, pgtype.TextFormatCode, col.Data)
-				if err != nil {
-					log.Error("cannot decode text column", "data", col.Data, "error", err)
-					continue
-				}
-				values[colName] = decodedColumn
+			value, err := celValue(typeMap, rel.Columns[idx].DataTypeOID, col.Data)
+			if err != nil {
+				log.Error("cannot decode text column", "data", col.Data, "error", err)
 				continue
 			}
-			values[colName] = string(col.Data)
+			values[colName] = value
 		}
 	}
 	return values
 }
 
+// withMetadata adds the change metadata to the variables of filter and set expressions.
+// old holds the previous values of the row, it is empty when they are not provided by the replica identity.
+// Tables with expressions cannot have columns with the same name, they are replaced for the others.
+func (op operation) withMetadata(env map[string]any, operation string, sourceTable string, old map[string]any) map[string]any {
+	if old == nil {
+		old = map[string]any{}
+	}
+	env["op"] = operation
+	env["old"] = old
+	env["sid"] = op.sid
+	env["database"] = op.database
+	env["source_table"] = sourceTable
+	env["lsn"] = op.lsn.String()
+	env["commit_time"] = types.Timestamp{Time: op.commitTime}
+	return env
+}
+
 func filter(log *slog.Logger, filterExpression cel.Program, args map[string]any) bool {
 	// no filter defined, pass
 	if filterExpression == nil {
@@ -144,7 +184,52 @@ func setter(log *slog.Logger, setExpression cel.Program, args map[string]any) an
 	return result
 }
 
-//nolint:funlen,gocognit,cyclop,gocyclo // It's OK for this to be long.
+// translate returns the values written to the destination: the values of the source row
+// or, when set expressions are configured, the values computed from the row.
+// Column renames, exclusions and constants are applied last.
+func (e MappingEntry) translate(log *slog.Logger, values map[string]any, env map[string]any) map[string]any {
+	if len(e.compiledSet) == 0 { // straight-through without translation
+		return e.mapColumns(values)
+	}
+	setValues := make(map[string]any)
+	for v, p := range e.compiledSet {
+		setValues[v] = setter(log, p, env)
+	}
+	return e.mapColumns(setValues)
+}
+
+// route returns the destination table of a row: the target of the entry or the table
+// returned by its target expression.
+func route(e MappingEntry, env map[string]any) (string, error) {
+	if e.compiledTarget == nil {
+		return e.destTable(), nil
+	}
+	result, err := evalExpression(e.compiledTarget, env)
+	if err != nil {
+		return "", fmt.Errorf("cannot evaluate target expression=%s, error=%w", e.TargetExpression, err)
+	}
+	table, ok := result.(types.String)
+	if !ok || table == "" {
+		return "", fmt.Errorf("target expression=%s did not return a table name, result=%v", e.TargetExpression, result)
+	}
+	return joinSchema(config.Database.Schema, string(table)), nil
+}
+
+// forEntry returns the operation applying a change of a source table to the destination table of an entry.
+func (op operation) forEntry(entry MappingEntry, rel PGRelation, destTable string, action string) operation {
+	op.sourceTable = rel.RelationName
+	op.syncTable = joinSchema(rel.Namespace, entry.Name)
+	op.destTable = destTable
+	_, op.destTableHasSID = DestTables()[destTable].Columns["sid"]
+	op.relation = entry.mapRelation(rel)
+	op.id = entry.ID
+	op.history = entry.history
+	op.opCode = opCodeFor(entry.Type, action)
+	return op
+}
+
+// processMessage decodes a replication message and applies it.
+// Changes of streamed in-progress transactions are buffered until the transaction is committed or aborted.
 func processMessage(
 	log *slog.Logger,
 	database SourceDatabase,
@@ -153,40 +238,115 @@ func processMessage(
 	xld pglogrepl.XLogData,
 	relations PGRelations,
 	typeMap *pgtype.Map,
-	transactionLSN *pglogrepl.LSN,
-	committedTransactionLSN *pglogrepl.LSN,
-	inStream *bool) {
+	state *replicationState) error {
 	var logicalMsg pglogrepl.Message
 	var err error
-	op := operation{
-		log:      log,
-		database: database.Name,
-		sid:      url.SID,
-		lsn:      *transactionLSN,
-	}
 	walData := xld.WALData
 	switch version {
 	case 1:
 		logicalMsg, err = pglogrepl.Parse(walData)
 	case 2:
-		logicalMsg, err = pglogrepl.ParseV2(walData, *inStream)
+		logicalMsg, err = pglogrepl.ParseV2(walData, state.inStream)
 	default:
 		log.Error("Unsupported message version", "version", version)
+		return nil
 	}
 	if err != nil {
 		log.Error("Parse logical replication message", "error", err)
-		return
+		return nil
+	}
+	if state.inStream {
+		if xid, ok := streamedChangeXid(logicalMsg, state.streamXid); ok {
+			log.Debug("Buffering streamed change", "xid", state.streamXid, "subxid", xid, "type", logicalMsg.Type())
+			err = state.streams.add(state.streamXid, xid, walData)
+			if err != nil {
+				return fmt.Errorf("cannot buffer streamed transaction, xid=%d, error=%w", state.streamXid, err)
+			}
+			return nil
+		}
+	}
+	return applyMessage(log, database, url, version, logicalMsg, relations, typeMap, state)
+}
+
+//nolint:funlen,gocognit,cyclop,gocyclo // It's OK for this to be long.
+func applyMessage(
+	log *slog.Logger,
+	database SourceDatabase,
+	url SourceURL,
+	version int,
+	logicalMsg pglogrepl.Message,
+	relations PGRelations,
+	typeMap *pgtype.Map,
+	state *replicationState) error {
+	op := operation{
+		log:        log,
+		database:   database.Name,
+		sid:        url.SID,
+		lsn:        state.transactionLSN,
+		commitTime: state.commitTime,
+		xid:        state.xid,
 	}
 	log.Debug("XLogData", "version", version, "type", logicalMsg.Type(), "message", logicalMsg)
 	switch logicalMsg := logicalMsg.(type) {
 	case *pglogrepl.BeginMessage:
-		*transactionLSN = logicalMsg.FinalLSN
+		state.transactionLSN = logicalMsg.FinalLSN
+		state.commitTime = logicalMsg.CommitTime
+		state.xid = logicalMsg.Xid
+		state.pending = nil
+		state.dispatched = false
+		state.commands = nil
 	case *pglogrepl.CommitMessage:
-		*committedTransactionLSN = *transactionLSN
+		state.flush(database.Name, url.SID)
+		state.commit(logicalMsg.CommitTime)
+		return state.runCommands(log, database.Name, url.SID)
+	case *pglogrepl.StreamStartMessageV2:
+		state.inStream = true
+		state.streamXid = logicalMsg.Xid
+	case *pglogrepl.StreamStopMessageV2:
+		state.inStream = false
+	case *pglogrepl.StreamAbortMessageV2:
+		state.streams.abort(log, logicalMsg.Xid, logicalMsg.SubXid)
+	case *pglogrepl.StreamCommitMessageV2:
+		log.Debug("Applying streamed transaction", "xid", logicalMsg.Xid, "lsn", logicalMsg.CommitLSN)
+		state.transactionLSN = logicalMsg.CommitLSN
+		state.commitTime = logicalMsg.CommitTime
+		state.xid = logicalMsg.Xid
+		state.pending = nil
+		state.dispatched = false
+		state.commands = nil
+		err := state.streams.commit(logicalMsg.Xid, func(data []byte) error {
+			m, err := pglogrepl.ParseV2(data, true)
+			if err != nil {
+				return fmt.Errorf("cannot parse streamed change, error=%w", err)
+			}
+			return applyMessage(log, database, url, version, m, relations, typeMap, state)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot apply streamed transaction, xid=%d, error=%w", logicalMsg.Xid, err)
+		}
+		state.flush(database.Name, url.SID)
+		state.commit(logicalMsg.CommitTime)
+		return state.runCommands(log, database.Name, url.SID)
 	case *pglogrepl.TypeMessage:
 	case *pglogrepl.OriginMessage:
-	case *pglogrepl.LogicalDecodingMessage:
-		log.Debug("Logical decoding message", "prefix", logicalMsg.Prefix, "content", logicalMsg.Content)
+	case *pglogrepl.LogicalDecodingMessage, *pglogrepl.LogicalDecodingMessageV2:
+		var m *pglogrepl.LogicalDecodingMessage
+		if v2, ok := logicalMsg.(*pglogrepl.LogicalDecodingMessageV2); ok {
+			m = &v2.LogicalDecodingMessage
+		} else {
+			m, _ = logicalMsg.(*pglogrepl.LogicalDecodingMessage)
+		}
+		log.Debug("Logical decoding message", "prefix", m.Prefix, "content", m.Content)
+		if m.Prefix == ddlMessagePrefix && m.Transactional {
+			replicateDDL(log, op, m.Content, state)
+		}
+		if config.App.CommandPrefix != "" && m.Prefix == config.App.CommandPrefix {
+			if !m.Transactional {
+				log.Warn("Ignoring non transactional command", "command", string(m.Content), "lsn", m.LSN)
+				break
+			}
+			state.commands = append(state.commands, string(m.Content))
+		}
 
 	case *pglogrepl.RelationMessage, *pglogrepl.RelationMessageV2:
 		var m *pglogrepl.RelationMessage
@@ -204,13 +364,17 @@ func processMessage(
 		}
 		for _, c := range m.Columns {
 			rel.Columns = append(rel.Columns, PGColumn{
-				Name:        c.Name,
-				PrimaryKey:  (c.Flags > 0),
-				DataTypeOID: c.DataType,
-				ColumnType:  "",
+				Name:         c.Name,
+				PrimaryKey:   (c.Flags > 0),
+				DataTypeOID:  c.DataType,
+				TypeModifier: c.TypeModifier,
+				ColumnType:   "",
 			})
 		}
 		relations[m.RelationID] = rel
+		if err := evolveSchema(log, op, rel, state); err != nil {
+			return err
+		}
 
 	case *pglogrepl.InsertMessage, *pglogrepl.InsertMessageV2:
 		var m *pglogrepl.InsertMessage
@@ -224,42 +388,28 @@ func processMessage(
 		rel, ok := relations[m.RelationID]
 		if !ok {
 			log.Error("unknown relation, protocol bug", "ID", m.RelationID)
-			return
+			return nil
 		}
-		entry, err := MappingTable.FindByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
+		entries, err := MappingTable().FindAllByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
 		if err != nil {
 			log.Error("cannot match table", "schema", rel.Namespace, "table", rel.RelationName)
-			return
+			return nil
 		}
 		values := getValues(rel, m.Tuple.Columns, typeMap)
-		env := getEnv(rel, m.Tuple.Columns, typeMap)
-		if !filter(log, entry.compiledFilter, env) {
-			return
-		}
-		if len(entry.compiledSet) != 0 { // we have set, map values to new ones
-			setValues := make(map[string]any)
-			for v, p := range entry.compiledSet {
-				setValues[v] = setter(log, p, env)
+		env := op.withMetadata(getEnv(rel, m.Tuple.Columns, typeMap), "insert", rel.RelationName, nil)
+		for _, entry := range entries {
+			if !filter(log, entry.compiledFilter, env) {
+				continue
 			}
-			values = setValues
-		}
-
-		log.Debug("XLogData INSERT", "namespace", rel.Namespace, "relation", rel.RelationName, "values", values)
-		destTable := joinSchema(config.Database.Schema, entry.Target)
-		op.sourceTable = rel.RelationName
-		op.destTable = destTable
-		_, op.destTableHasSID = DestTables[destTable].Columns["sid"]
-		op.values = values
-		op.id = entry.ID
-		if entry.Type == TableTypeHistory {
-			t0, _ := time.Parse("2006-01-02", "1900-01-01")
-			err = op.insertHistory(destTable, t0, values)
-		} else {
-			op.opCode = "ic"
-			SendWork(op)
-		}
-		if err != nil {
-			return
+			destTable, err := route(entry, env)
+			if err != nil {
+				log.Error("cannot route row, skipping", "schema", rel.Namespace, "table", rel.RelationName, "error", err)
+				continue
+			}
+			insertOp := op.forEntry(entry, rel, destTable, "i")
+			insertOp.values = entry.translate(log, values, env)
+			log.Debug("XLogData INSERT", "namespace", rel.Namespace, "relation", rel.RelationName, "destTable", destTable, "values", insertOp.values)
+			state.dispatch(insertOp)
 		}
 
 	case *pglogrepl.UpdateMessage, *pglogrepl.UpdateMessageV2:
@@ -274,56 +424,61 @@ func processMessage(
 		rel, ok := relations[m.RelationID]
 		if !ok {
 			log.Error("unknown relation, protocol bug", "ID", m.RelationID)
-			return
+			return nil
 		}
-		entry, err := MappingTable.FindByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
+		entries, err := MappingTable().FindAllByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
 		if err != nil {
 			log.Error("cannot match table", "schema", rel.Namespace, "table", rel.RelationName)
-			return
-		}
-
-		op.values = getValues(rel, m.NewTuple.Columns, typeMap)
-		env := getEnv(rel, m.NewTuple.Columns, typeMap)
-		if !filter(log, entry.compiledFilter, env) {
-			return
+			return nil
 		}
 
 		op.old = m.OldTupleType
+		var oldEnv map[string]any
 		if op.old != 0 {
 			op.oldValues = getValues(rel, m.OldTuple.Columns, typeMap)
+			oldEnv = getEnv(rel, m.OldTuple.Columns, typeMap)
+		}
+		op.values = getValues(rel, m.NewTuple.Columns, typeMap)
+		env := op.withMetadata(getEnv(rel, m.NewTuple.Columns, typeMap), "update", rel.RelationName, maps.Clone(oldEnv))
+		if op.old != 0 {
+			oldEnv = op.withMetadata(oldEnv, "update", rel.RelationName, nil)
 		}
 
-		if len(entry.compiledSet) != 0 { // we have set, map values to new ones
-			setValues := make(map[string]any)
-			for v, p := range entry.compiledSet {
-				setValues[v] = setter(log, p, env)
+		for _, entry := range entries {
+			if !filter(log, entry.compiledFilter, env) {
+				continue
+			}
+			destTable, err := route(entry, env)
+			if err != nil {
+				log.Error("cannot route row, skipping", "schema", rel.Namespace, "table", rel.RelationName, "error", err)
+				continue
 			}
-			op.values = setValues
+			updateOp := op.forEntry(entry, rel, destTable, "u")
+			updateOp.values = entry.translate(log, op.values, env)
 			if op.old != 0 {
-				oldEnv := getEnv(rel, m.OldTuple.Columns, typeMap)
-				oldValues := make(map[string]any)
-				for v, p := range entry.compiledSet {
-					oldValues[v] = setter(log, p, oldEnv)
+				updateOp.oldValues = entry.translate(log, op.oldValues, oldEnv)
+			}
+			if entry.compiledTarget != nil && op.old != 0 {
+				// the row moves when the target computed from the old values is another table
+				oldTable, err := route(entry, oldEnv)
+				if err == nil && oldTable != destTable {
+					if entry.Type != TableTypeAppend {
+						deleteOp := op.forEntry(entry, rel, oldTable, "d")
+						deleteOp.values = updateOp.oldValues
+						deleteOp.oldValues = nil
+						log.Debug("XLogData UPDATE moves row", "namespace", rel.Namespace, "relation", rel.RelationName, "from", oldTable, "to", destTable)
+						state.dispatch(deleteOp)
+					}
+					insertOp := op.forEntry(entry, rel, destTable, "i")
+					insertOp.values = updateOp.values
+					insertOp.old = 0
+					insertOp.oldValues = nil
+					updateOp = insertOp
 				}
-				op.oldValues = oldValues
 			}
-		}
-
-		log.Debug("XLogData UPDATE", "namespace", rel.Namespace, "relation", rel.RelationName, "oldValues", op.oldValues, "values", op.values)
-		destTable := joinSchema(config.Database.Schema, entry.Target)
-		op.sourceTable = rel.RelationName
-		op.destTable = destTable
-		_, op.destTableHasSID = DestTables[destTable].Columns["sid"]
-		op.relation = rel
-		op.id = entry.ID
-		if entry.Type == TableTypeHistory {
-			err = op.updateHistory(destTable, rel, op.values, op.old, op.oldValues)
-		} else {
-			op.opCode = "uc"
-			SendWork(op)
-		}
-		if err != nil {
-			return
+			log.Debug("XLogData UPDATE", "namespace", rel.Namespace, "relation", rel.RelationName, "destTable", destTable,
+				"oldValues", updateOp.oldValues, "values", updateOp.values)
+			state.dispatch(updateOp)
 		}
 
 	case *pglogrepl.DeleteMessage, *pglogrepl.DeleteMessageV2:
@@ -338,54 +493,84 @@ func processMessage(
 		rel, ok := relations[m.RelationID]
 		if !ok {
 			log.Error("unknown relation, protocol bug", "ID", m.RelationID)
-			return
+			return nil
 		}
-		entry, err := MappingTable.FindByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
+		entries, err := MappingTable().FindAllByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
 		if err != nil {
 			log.Error("cannot match table", "schema", rel.Namespace, "table", rel.RelationName)
-			return
-		}
-		if entry.Type == TableTypeAppend {
-			log.Debug("XLogDataV1 DELETE %s.%s ignored for append table type", rel.Namespace, rel.RelationName)
-			return
+			return nil
 		}
-		op.values = getValues(rel, m.OldTuple.Columns, typeMap)
+		op.old = m.OldTupleType
+		values := getValues(rel, m.OldTuple.Columns, typeMap)
 		env := getEnv(rel, m.OldTuple.Columns, typeMap)
-		if !filter(log, entry.compiledFilter, env) {
-			return
-		}
-
-		if len(entry.compiledSet) != 0 { // we have set, map values to new ones
-			setValues := make(map[string]any)
-			for v, p := range entry.compiledSet {
-				setValues[v] = setter(log, p, env)
+		env = op.withMetadata(env, "delete", rel.RelationName, maps.Clone(env))
+		for _, entry := range entries {
+			if entry.Type == TableTypeAppend {
+				log.Debug("XLogData DELETE ignored for append table type", "namespace", rel.Namespace, "relation", rel.RelationName)
+				continue
+			}
+			if !filter(log, entry.compiledFilter, env) {
+				continue
+			}
+			destTable, err := route(entry, env)
+			if err != nil {
+				log.Error("cannot route row, skipping", "schema", rel.Namespace, "table", rel.RelationName, "error", err)
+				continue
 			}
-			op.values = setValues
+			deleteOp := op.forEntry(entry, rel, destTable, "d")
+			deleteOp.values = entry.translate(log, values, env)
+			log.Debug("XLogData DELETE", "namespace", rel.Namespace, "relation", rel.RelationName, "destTable", destTable,
+				"values", deleteOp.values, "old", m.OldTupleType)
+			state.dispatch(deleteOp)
 		}
 
-		log.Debug("XLogDataV1 DELETE", "namespace", rel.Namespace, "relation", rel.RelationName, "values", op.values, "old", m.OldTupleType)
-		destTable := joinSchema(config.Database.Schema, entry.Target)
-		op.sourceTable = rel.RelationName
-		op.destTable = destTable
-		_, op.destTableHasSID = DestTables[destTable].Columns["sid"]
-		op.relation = relations[m.RelationID]
-		op.old = m.OldTupleType
-		op.id = entry.ID
-		if entry.Type == TableTypeHistory {
-			err = op.deleteHistory(destTable, relations[m.RelationID], op.values, m.OldTupleType)
+	case *pglogrepl.TruncateMessage, *pglogrepl.TruncateMessageV2:
+		var m *pglogrepl.TruncateMessage
+		if version == 1 {
+			m, _ = logicalMsg.(*pglogrepl.TruncateMessage)
 		} else {
-			op.opCode = "dc"
-			SendWork(op)
-		}
-		if err != nil {
-			return
+			temp, _ := logicalMsg.(*pglogrepl.TruncateMessageV2)
+			m = &temp.TruncateMessage
 		}
 
-	case *pglogrepl.TruncateMessage:
-	case *pglogrepl.TruncateMessageV2:
-		// ...
+		for _, relationID := range m.RelationIDs {
+			rel, ok := relations[relationID]
+			if !ok {
+				log.Error("unknown relation, protocol bug", "ID", relationID)
+				continue
+			}
+			entries, err := MappingTable().FindAllByName(database.Name, joinSchema(rel.Namespace, rel.RelationName))
+			if err != nil {
+				log.Error("cannot match table", "schema", rel.Namespace, "table", rel.RelationName)
+				continue
+			}
+			for _, entry := range entries {
+				if entry.Type == TableTypeAppend {
+					log.Debug("XLogData TRUNCATE ignored for append table type", "namespace", rel.Namespace, "relation", rel.RelationName)
+					continue
+				}
+				if entry.Name != rel.RelationName {
+					// rows of a single partition cannot be identified in the consolidated destination table
+					log.Error("XLogData TRUNCATE of a partition is not supported, destination table is not in sync",
+						"namespace", rel.Namespace, "relation", rel.RelationName, "table", entry.Name)
+					continue
+				}
+				if entry.compiledTarget != nil {
+					// the destination tables are only known for rows
+					log.Error("XLogData TRUNCATE of a table with a target expression is not supported, destination tables are not in sync",
+						"namespace", rel.Namespace, "relation", rel.RelationName, "target_expression", entry.TargetExpression)
+					continue
+				}
+
+				log.Debug("XLogData TRUNCATE", "namespace", rel.Namespace, "relation", rel.RelationName, "option", m.Option)
+				truncateOp := op.forEntry(entry, rel, entry.destTable(), "t")
+				truncateOp.truncateOption = m.Option
+				state.dispatch(truncateOp)
+			}
+		}
 
 	default:
 		log.Warn("Unknown message type in pgoutput stream", "type", logicalMsg.Type().String())
 	}
+	return nil
 }
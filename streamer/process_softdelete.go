@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// softDeleteMark returns the value of the deleted column of a soft deleted row,
+// true for a boolean flag or the deletion time for a timestamp.
+func (op operation) softDeleteMark() any {
+	if DestTables()[op.destTable].Columns[op.history.deleted].DataTypeOID == pgtype.BoolOID {
+		return true
+	}
+	return op.validTime()
+}
+
+// softDeleteCleared returns the value of the deleted column of a live row.
+func (op operation) softDeleteCleared() any {
+	if DestTables()[op.destTable].Columns[op.history.deleted].DataTypeOID == pgtype.BoolOID {
+		return false
+	}
+	return nil
+}
+
+// softDeleted returns the condition selecting soft deleted rows.
+func (op operation) softDeleted() string {
+	if DestTables()[op.destTable].Columns[op.history.deleted].DataTypeOID == pgtype.BoolOID {
+		return op.history.deleted
+	}
+	return op.history.deleted + " IS NOT NULL"
+}
+
+// notSoftDeleted returns the condition selecting live rows, including rows with a NULL flag.
+func (op operation) notSoftDeleted() string {
+	if DestTables()[op.destTable].Columns[op.history.deleted].DataTypeOID == pgtype.BoolOID {
+		return op.history.deleted + " IS NOT TRUE"
+	}
+	return op.history.deleted + " IS NULL"
+}
+
+// insertSoftDelete inserts a row. When a row with the same key was soft deleted,
+// it is restored with the new values instead. Rows of tables without key are always inserted.
+func (op operation) insertSoftDelete(tx pgx.Tx) error {
+	log := op.log.With("op", "insertSoftDelete", "table", op.destTable)
+
+	t0 := time.Now()
+	op.values = maps.Clone(op.values)
+	op.values[op.history.deleted] = op.softDeleteCleared()
+	keys := op.rowKeys(op.values, nil)
+	if len(keys) == 0 {
+		log.Debug("No key to restore a soft deleted row, inserting")
+		return op.insertClone(tx)
+	}
+
+	// Build query
+	args, err := op.buildSetList(op.destTable, make([]arg, 0), op.values)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s=$1", op.destTable, args[0].Attribute)
+	queryParameters := []any{args[0].Value}
+	for i := 1; i < len(args); i++ {
+		query = fmt.Sprintf("%s, %s=$%d", query, args[i].Attribute, i+1)
+		queryParameters = append(queryParameters, args[i].Value)
+	}
+	query = fmt.Sprintf("%s WHERE %s", query, op.softDeleted())
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s AND sid=$%d", query, len(queryParameters))
+	}
+	query, queryParameters = appendWhere(query, keys, queryParameters)
+
+	// Run query
+	log.Debug("restore", "query", query, "queryParameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		log.Error("can't restore", "table", op.destTable, "query", query, "error", err)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("insertSoftDelete failed, error=%w", err)
+	}
+	if rows.RowsAffected() > 0 {
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "success").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "insert", "success").Observe(time.Since(t0).Seconds())
+		return nil
+	}
+	return op.insertClone(tx)
+}
+
+// deleteSoftDelete marks a row as deleted instead of removing it.
+func (op operation) deleteSoftDelete(tx pgx.Tx) error {
+	log := op.log.With("op", "deleteSoftDelete", "table", op.destTable)
+
+	t0 := time.Now()
+	queryParameters := []any{op.softDeleteMark()}
+
+	// Build query
+	query := fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s", op.destTable, op.history.deleted, op.notSoftDeleted())
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s AND sid=$%d", query, len(queryParameters))
+	}
+	query, queryParameters = op.deleteWhere(query, queryParameters)
+
+	// Run query
+	log.Debug("delete", "query", query, "parameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Observe(time.Since(t0).Seconds())
+		log.Error("can't soft delete", "table", op.destTable, "query", query, "error", err)
+		return fmt.Errorf("deleteSoftDelete failed: error=%w", err)
+	}
+	if rows.RowsAffected() == 0 {
+		log.Error("did not find row to delete, destination database was not in sync", "query", query, "parameters", queryParameters)
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "failure").Observe(time.Since(t0).Seconds())
+		return fmt.Errorf("deleteSoftDelete failed: %w", errNoAffectedRows)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "delete", "success").Observe(time.Since(t0).Seconds())
+	return nil
+}
+
+// truncateSoftDelete marks all rows received from the source as deleted.
+func (op operation) truncateSoftDelete(tx pgx.Tx) error {
+	log := op.log.With("op", "truncateSoftDelete", "table", op.destTable)
+
+	t0 := time.Now()
+	queryParameters := []any{op.softDeleteMark()}
+
+	// Build query
+	query := fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s", op.destTable, op.history.deleted, op.notSoftDeleted())
+	if op.destTableHasSID {
+		queryParameters = append(queryParameters, op.sid)
+		query = fmt.Sprintf("%s AND sid=$%d", query, len(queryParameters))
+	}
+
+	// Run query
+	log.Debug("truncate", "query", query, "parameters", queryParameters)
+	rows, err := tx.Exec(context.Background(), query, queryParameters...)
+	if err != nil {
+		requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "failure").Inc()
+		requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "failure").Observe(time.Since(t0).Seconds())
+		log.Error("can't soft delete", "table", op.destTable, "query", query, "error", err)
+		return fmt.Errorf("truncateSoftDelete failed: error=%w", err)
+	}
+	requestsTotal.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "success").Inc()
+	requestDuration.WithLabelValues(op.database, op.sid, op.sourceTable, "truncate", "success").Observe(time.Since(t0).Seconds())
+	log.Debug("truncate", "RowsAffected", rows.RowsAffected())
+	return nil
+}
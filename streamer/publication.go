@@ -12,27 +12,36 @@ import (
 
 type Publications []string
 
+// findBaseTables returns the tables of a database to publish. A source table replicated
+// to several destinations has several entries but is published once.
 func findBaseTables(db string) []string {
 	var p []string
-	for i := range MappingTable {
+	seen := mapset.NewSet[string]()
+	add := func(table string) {
+		if seen.Add(table) {
+			p = append(p, table)
+		}
+	}
+	entries := MappingTable()
+	for i := range entries {
 		// Check table is being replicated and belongs to us
-		if !MappingTable[i].Replicated || (MappingTable[i].DBName != db) {
+		if !entries[i].Replicated || (entries[i].DBName != db) {
 			continue
 		}
 		// if this is a partitioned table, add all partitions
-		if len(MappingTable[i].Partitions) > 0 {
-			for j := range MappingTable[i].Partitions {
-				p = append(p, joinSchema(MappingTable[i].Schema, MappingTable[i].Partitions[j]))
+		if len(entries[i].Partitions) > 0 {
+			for j := range entries[i].Partitions {
+				add(joinSchema(entries[i].Schema, entries[i].Partitions[j]))
 			}
 		} else {
-			p = append(p, joinSchema(MappingTable[i].Schema, MappingTable[i].Name))
+			add(joinSchema(entries[i].Schema, entries[i].Name))
 		}
 	}
 	return p
 }
 
 func makePublication(database SourceDatabase) string {
-	log.Debug("Creating publication - find tables", "database", database, "MappingTable", MappingTable)
+	log.Debug("Creating publication - find tables", "database", database, "MappingTable", MappingTable())
 	if len(database.Tables) == 0 {
 		return ""
 	}
@@ -15,7 +15,144 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
-type Partitions map[string][]string
+type (
+	Partitions map[string][]string
+
+	// replicationState holds the position in the replication stream of a source between messages.
+	replicationState struct {
+		transactionLSN          pglogrepl.LSN
+		committedTransactionLSN pglogrepl.LSN
+		commitTime              time.Time
+		xid                     uint32
+		// whenever we get StreamStartMessage we set inStream to true and then pass it to DecodeV2 function
+		// on StreamStopMessage we set it back to false
+		inStream  bool
+		streamXid uint32
+		streams   streamBuffers
+		// operations of the current transaction waiting for its commit in transactional apply mode
+		pending []operation
+		// whether operations were sent for the current transaction
+		dispatched bool
+		// source transactions not yet confirmed, used to measure the time lag
+		commits      []sourceCommit
+		serverWALEnd pglogrepl.LSN
+		// commands received in the current transaction, run once it is committed
+		commands []string
+	}
+
+	sourceCommit struct {
+		lsn  pglogrepl.LSN
+		time time.Time
+	}
+)
+
+// dispatch sends an operation to the workers. In transactional apply mode, operations are held
+// until the end of the source transaction so that it is applied atomically. Operations of a table
+// being resynced are held until it is copied, outside of their source transaction.
+func (state *replicationState) dispatch(op operation) {
+	if fenced(op) {
+		op.log.Debug("Skipping operation included in table resync", "table", op.destTable, "lsn", op.lsn)
+		return
+	}
+	state.dispatched = true
+	if held(op) {
+		return
+	}
+	if config.App.ApplyMode != ApplyModeTransactional {
+		SendWork(op)
+		return
+	}
+	state.pending = append(state.pending, op)
+}
+
+// flush sends the operations of a committed source transaction as a single unit of work.
+func (state *replicationState) flush(database, sid string) {
+	if len(state.pending) == 0 {
+		return
+	}
+	SendWork(operation{
+		log:      state.pending[0].log,
+		database: database,
+		sid:      sid,
+		opCode:   "tx",
+		lsn:      state.transactionLSN,
+		batch:    state.pending,
+	})
+	state.pending = nil
+}
+
+// commit records the end of a source transaction.
+// Transactions without operations for the destination are not tracked as they are never written.
+func (state *replicationState) commit(commitTime time.Time) {
+	if state.dispatched {
+		state.commits = append(state.commits, sourceCommit{lsn: state.transactionLSN, time: commitTime})
+	}
+	state.dispatched = false
+	state.committedTransactionLSN = state.transactionLSN
+}
+
+// lag returns the WAL and time lag of the destination relative to the source.
+// Transactions confirmed at the given position are forgotten.
+func (state *replicationState) lag(confirmed pglogrepl.LSN) (float64, float64) {
+	i := 0
+	for i < len(state.commits) && state.commits[i].lsn <= confirmed {
+		i++
+	}
+	state.commits = state.commits[i:]
+	bytes, seconds := 0.0, 0.0
+	if state.serverWALEnd > confirmed {
+		bytes = float64(state.serverWALEnd - confirmed)
+	}
+	if len(state.commits) > 0 {
+		seconds = time.Since(state.commits[0].time).Seconds()
+	}
+	return bytes, seconds
+}
+
+// monitorSlot periodically measures the WAL retained on the source by the replication slot.
+// It uses its own connection as the replication connection is busy streaming.
+func monitorSlot(ctx context.Context, log *slog.Logger, database, sid, sourceURL, slotName string) {
+	if config.Maintenance.SlotCheckInterval <= 0 {
+		return
+	}
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+	ticker := time.NewTicker(time.Duration(config.Maintenance.SlotCheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var err error
+		if conn == nil {
+			databaseURL := strings.Split(sourceURL, "?")[0] + "?application_name=kuvasz_monitor_" + database
+			conn, err = pgx.Connect(ctx, databaseURL)
+			if err != nil {
+				log.Error("cannot connect to check replication slot", "error", err)
+				conn = nil
+				continue
+			}
+		}
+		var retained int64
+		err = conn.QueryRow(ctx,
+			"select coalesce(pg_wal_lsn_diff(pg_current_wal_lsn(), restart_lsn), 0)::bigint from pg_replication_slots where slot_name=$1",
+			slotName).Scan(&retained)
+		if err != nil {
+			log.Error("cannot check replication slot", "slotname", slotName, "error", err)
+			conn.Close(context.Background())
+			conn = nil
+			continue
+		}
+		log.Debug("Replication slot retained WAL", "slotname", slotName, "bytes", retained)
+		slotRetainedBytes.WithLabelValues(database, sid).Set(float64(retained))
+	}
+}
 
 func pluginArguments(pgVersion int, slotName string) (int, []string) {
 	protocolVersion := 2
@@ -40,11 +177,13 @@ func pluginArguments(pgVersion int, slotName string) (int, []string) {
 	return protocolVersion, arg
 }
 
+// createReplicationSlot creates the replication slot if it does not exist and exports its snapshot.
+// It returns whether the slot already existed, the LSN to start streaming from and the name of the
+// exported snapshot. The snapshot remains valid until the next command is run on the replication connection.
 func createReplicationSlot(
 	log *slog.Logger,
 	conn *pgx.Conn,
-	slotName string,
-	xlogpos pglogrepl.LSN) (bool, pglogrepl.LSN, error) {
+	slotName string) (bool, pglogrepl.LSN, string, error) {
 	ctx := context.Background()
 	replConn := conn.PgConn()
 	log.Info("Checking replication slot", "slotname", slotName)
@@ -56,14 +195,14 @@ func createReplicationSlot(
 		"select active, active_pid, confirmed_flush_lsn from pg_replication_slots where slot_name=$1;",
 		slotName).Scan(&active, &activePid, &lsn)
 	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
-		return false, 0, fmt.Errorf("cannot check existence of replication slot: %w", err)
+		return false, 0, "", fmt.Errorf("cannot check existence of replication slot: %w", err)
 	}
 	if active {
-		return false, 0, fmt.Errorf("cannot create replication, slot is active, slot_name=%s, active_pid=%d", slotName, *activePid)
+		return false, 0, "", fmt.Errorf("cannot create replication, slot is active, slot_name=%s, active_pid=%d", slotName, *activePid)
 	}
 	if !errors.Is(err, pgx.ErrNoRows) {
 		log.Debug("Replication slot exists", "lsn", lsn)
-		return true, lsn, nil
+		return true, lsn, "", nil
 	}
 	replicationSlotResult, err := pglogrepl.CreateReplicationSlot(
 		ctx,
@@ -71,14 +210,18 @@ func createReplicationSlot(
 		slotName, "pgoutput",
 		pglogrepl.CreateReplicationSlotOptions{
 			Temporary:      false,
-			SnapshotAction: "",
+			SnapshotAction: "EXPORT_SNAPSHOT",
 			Mode:           pglogrepl.LogicalReplication,
 		})
 	if err != nil {
-		return false, 0, fmt.Errorf("cannot create replication slot: %w", err)
+		return false, 0, "", fmt.Errorf("cannot create replication slot: %w", err)
 	}
 	log.Debug("Created replication slot", "result", replicationSlotResult)
-	return false, xlogpos, nil
+	lsn, err = pglogrepl.ParseLSN(replicationSlotResult.ConsistentPoint)
+	if err != nil {
+		return false, 0, "", fmt.Errorf("cannot parse consistent point=%s: %w", replicationSlotResult.ConsistentPoint, err)
+	}
+	return false, lsn, replicationSlotResult.SnapshotName, nil
 }
 
 // pgVersion gets postgres server version and checks it is supported.
@@ -103,16 +246,20 @@ func pgVersion(log *slog.Logger, conn *pgx.Conn) (int, error) {
 
 //nolint:funlen,gocognit,cyclop,gocyclo // This is is just multiple steps and needs to be in a single function
 func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url *SourceURL) error {
-	// Create command channel
-	url.commandChannel = make(chan string)
-	syncContext, syncCancel := context.WithCancel(rootContext)
-	defer syncCancel()
+	// Listen to commands, the replication is interrupted with the command as cause
+	syncContext, syncCancel := context.WithCancelCause(rootContext)
+	defer syncCancel(nil)
 	go func() {
-		select {
-		case <-url.commandChannel:
-			syncCancel()
-		case <-syncContext.Done():
-		case <-rootContext.Done():
+		for {
+			select {
+			case command := <-url.commandChannel:
+				if err := commandError(command); err != nil {
+					syncCancel(err)
+					return
+				}
+			case <-syncContext.Done():
+				return
+			}
 		}
 	}()
 
@@ -164,6 +311,15 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 		return fmt.Errorf("wal_level must be logical, got %s, change configuration in postgresql.conf and restart server", walLevel)
 	}
 
+	// Install the event trigger emitting DDL in the replication stream
+	if config.App.DDLReplication {
+		if ver < 14 {
+			log.Warn("DDL replication requires Postgres 14 or later", "version", ver)
+		} else if err = installDDLTrigger(ctx, log, conn); err != nil {
+			return err
+		}
+	}
+
 	// Check existing publication and create if needed, drop replication slot if required
 	slotName := "kuvasz_" + database.Name + "_" + url.SID
 	slotName = strings.ReplaceAll(slotName, "-", "_")
@@ -204,6 +360,15 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 				return fmt.Errorf("cannot drop publication, error=%w", err)
 			}
 		}
+		// the slot will be created, record that all tables must be synced
+		tables := make([]string, 0, len(database.Tables))
+		for sourceTableName := range database.Tables {
+			tables = append(tables, sourceTableName)
+		}
+		err = markTablesPending(ctx, database.Name, url.SID, database.Tables, tables, true)
+		if err != nil {
+			return fmt.Errorf("cannot record full sync state, error=%w", err)
+		}
 		q := "create publication " + slotName + makePublication(database)
 		log.Debug("Creating publication", "publication", slotName, "q", q)
 		_, err = conn.Exec(context.Background(), q)
@@ -212,21 +377,22 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 		}
 	}
 	// Create slot if it does not exist, fail if there is an existing consumer
-	oldSlot, lsn, err := createReplicationSlot(log, conn, slotName, sysident.XLogPos)
+	oldSlot, lsn, snapshotName, err := createReplicationSlot(log, conn, slotName)
 	if err != nil {
 		return fmt.Errorf("cannot create replication slot, error=%w", err)
 	}
 
-	// Perform full table sync if slot was just created
+	// Perform full table sync if slot was just created.
+	// The replication connection must stay idle until the sync is finished to keep the exported snapshot valid.
 	if !oldSlot {
-		err := syncAllTables(log, database.Name, url.SID, database.Tables, replConn)
+		err := syncAllTables(log, database.Name, url.SID, url.URL, snapshotName, database.Tables)
 		if err != nil {
 			return fmt.Errorf("cannot perform initial sync, error=%w", err)
 		}
 		log.Debug("Finished full table sync")
 		time.Sleep(time.Duration(config.Maintenance.StartDelay) * time.Second)
 	} else {
-		err := syncNewTables(log, database.Name, url.SID, database.Tables, newTables, replConn)
+		err := syncNewTables(log, database.Name, url, database.Tables, newTables)
 		if err != nil {
 			return fmt.Errorf("cannot perform initial sync for new tables, error=%w", err)
 		}
@@ -250,6 +416,8 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 		return fmt.Errorf("cannot start replication, error=%w", err)
 	}
 	log.Info("Started logical replication slot", "slotname", slotName, "lsn", lsn)
+	setURLState(database.Name, url.SID, URLStateRunning)
+	go monitorSlot(syncContext, log, database.Name, url.SID, url.URL, slotName)
 
 	// Start streaming and processing messages
 	standbyMessageTimeout := time.Second * 1
@@ -257,18 +425,19 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 	relations := PGRelations{}
 	typeMap := pgtype.NewMap()
 
-	// whenever we get StreamStartMessage we set inStream to true and then pass it to DecodeV2 function
-	// on StreamStopMessage we set it back to false
-	inStream := false
-	transactionLSN := pglogrepl.LSN(0)
-	committedTransactionLSN := lsn
+	state := &replicationState{
+		committedTransactionLSN: lsn,
+		streams:                 make(streamBuffers),
+	}
+	defer state.streams.close()
 	SetCommittedLSN(database.Name, url.SID, lsn)
+	resetHolds(database.Name, url.SID)
 
 	for {
 		urlHeartbeat.WithLabelValues(database.Name, url.SID).Set(float64(time.Now().Unix()))
 
 		if time.Now().After(nextStandbyMessageDeadline) {
-			clientXLogPos := GetCommittedLSN(database.Name, url.SID, committedTransactionLSN)
+			clientXLogPos := GetCommittedLSN(database.Name, url.SID, state.committedTransactionLSN)
 			if clientXLogPos != 0 {
 				err = pglogrepl.SendStandbyStatusUpdate(
 					ctx,
@@ -284,6 +453,10 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 					return fmt.Errorf("cannot send SendStandbyStatusUpdate, error=%w", err)
 				}
 				log.Debug("Sent Standby status message", "pos", clientXLogPos.String())
+				SetConfirmedLSN(database.Name, url.SID, clientXLogPos)
+				bytes, seconds := state.lag(clientXLogPos)
+				lagBytes.WithLabelValues(database.Name, url.SID).Set(bytes)
+				lagSeconds.WithLabelValues(database.Name, url.SID).Set(seconds)
 			}
 			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
 		}
@@ -296,6 +469,11 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 				continue
 			}
 			if errors.Is(err, context.Canceled) {
+				cause := context.Cause(syncContext)
+				if errors.Is(cause, errRestart) || errors.Is(cause, errPause) {
+					log.Info("Interrupting replication", "cause", cause, "lsn", state.committedTransactionLSN)
+					return cause
+				}
 				log.Info("Got restart message, restarting replication")
 				return nil
 			}
@@ -322,6 +500,9 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 				"ServerWALEnd", pkm.ServerWALEnd,
 				"ServerTime", pkm.ServerTime,
 				"ReplyRequested", pkm.ReplyRequested)
+			if pkm.ServerWALEnd > state.serverWALEnd {
+				state.serverWALEnd = pkm.ServerWALEnd
+			}
 			if pkm.ReplyRequested {
 				nextStandbyMessageDeadline = time.Time{}
 			}
@@ -333,7 +514,32 @@ func ReplicateDatabase(rootContext context.Context, database SourceDatabase, url
 			}
 
 			log.Debug("XLogData", "WALStart", xld.WALStart, "ServerWALEnd", xld.ServerWALEnd, "ServerTime", xld.ServerTime)
-			processMessage(log, database, *url, protocolVersion, xld, relations, typeMap, &transactionLSN, &committedTransactionLSN, &inStream)
+			if xld.ServerWALEnd > state.serverWALEnd {
+				state.serverWALEnd = xld.ServerWALEnd
+			}
+			err = processMessage(log, database, *url, protocolVersion, xld, relations, typeMap, state)
+			if errors.Is(err, errPause) {
+				// paused by a command, confirm its transaction so that it is not received again on resume
+				err = pglogrepl.SendStandbyStatusUpdate(
+					ctx,
+					replConn,
+					pglogrepl.StandbyStatusUpdate{
+						WALWritePosition: state.committedTransactionLSN,
+						WALFlushPosition: state.committedTransactionLSN,
+						WALApplyPosition: state.committedTransactionLSN,
+						ClientTime:       time.Now(),
+						ReplyRequested:   false,
+					})
+				if err != nil {
+					return fmt.Errorf("cannot send SendStandbyStatusUpdate, error=%w", err)
+				}
+				SetConfirmedLSN(database.Name, url.SID, state.committedTransactionLSN)
+				log.Info("Interrupting replication", "cause", errPause, "lsn", state.committedTransactionLSN)
+				return errPause
+			}
+			if err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -342,13 +548,29 @@ func DoReplicateDatabase(rootContext context.Context, database SourceDatabase, u
 	defer wg.Done()
 	for {
 		err := ReplicateDatabase(rootContext, database, url)
-		if err == nil {
+		switch {
+		case err == nil:
 			log.Error("Interrupted", "db-sid", database.Name+"-"+url.SID, "url", url.URL)
 			return
+		case errors.Is(err, errRestart):
+			log.Info("Restarting replication", "db-sid", database.Name+"-"+url.SID, "url", url.URL)
+			continue
+		case errors.Is(err, errPause):
+			// the replication slot keeps the confirmed position until the replication is resumed
+			log.Info("Paused replication", "db-sid", database.Name+"-"+url.SID, "url", url.URL)
+			setURLState(database.Name, url.SID, URLStatePaused)
+			if !waitResume(rootContext, url) {
+				return
+			}
+			log.Info("Resuming replication", "db-sid", database.Name+"-"+url.SID, "url", url.URL)
+			continue
 		}
 
 		log.Error("cannot start replication", "error", err, "db-sid", database.Name+"-"+url.SID, "url", url.URL)
 		URLError[url.URL] = err.Error()
-		time.Sleep(60 * time.Second)
+		setURLState(database.Name, url.SID, URLStateError)
+		if !waitRetry(rootContext, database.Name, url, 60*time.Second) {
+			return
+		}
 	}
 }
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// resync modes.
+	ResyncModeTruncate = "truncate"
+	ResyncModeSwap     = "swap"
+
+	// resync states.
+	ResyncStateRunning = "running"
+	ResyncStateDone    = "done"
+	ResyncStateFailed  = "failed"
+
+	resyncWaitTimeout = 2 * time.Minute
+)
+
+// resyncHold is the snapshot position of a source and the changes of a table received after it.
+type resyncHold struct {
+	lsn pglogrepl.LSN
+	ops []operation
+}
+
+type ResyncStatus struct {
+	ID         int64      `json:"id"`
+	Table      string     `json:"table"`
+	Mode       string     `json:"mode"`
+	SIDs       []string   `json:"sids"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+var (
+	// resyncFences holds, per source and destination table or source table, the position of the last snapshot.
+	// Changes before this position are already part of the copied rows and must not be applied again.
+	resyncFences = struct {
+		sync.Mutex
+		m map[string]pglogrepl.LSN
+	}{m: make(map[string]pglogrepl.LSN)}
+
+	// resyncHolds holds, per source and destination table being copied, the changes received after the snapshot.
+	// They are applied once the copy is done.
+	resyncHolds = struct {
+		sync.Mutex
+		m map[string]*resyncHold
+	}{m: make(map[string]*resyncHold)}
+
+	resyncJobs = struct {
+		sync.Mutex
+		m map[int64]ResyncStatus
+	}{m: make(map[int64]ResyncStatus)}
+)
+
+func setResyncFence(database, sid, destTable string, lsn pglogrepl.LSN) {
+	resyncFences.Lock()
+	defer resyncFences.Unlock()
+	resyncFences.m[database+"-"+sid+"-"+destTable] = lsn
+}
+
+// syncFenceKey identifies the sync fence of a source table, its name is qualified with its schema
+// as in the sync state and changes of partitions use the name of the mapped table.
+func syncFenceKey(database, sid, sourceTable string) string {
+	schema, table := splitSchema(sourceTable)
+	return database + "-" + sid + ":" + joinSchema(schema, table)
+}
+
+// setSyncFence skips the changes of a source table older than the snapshot it was copied from.
+// Events tables are not copied, their changes are not skipped.
+func setSyncFence(database, sid, sourceTable string, lsn pglogrepl.LSN) {
+	resyncFences.Lock()
+	defer resyncFences.Unlock()
+	resyncFences.m[syncFenceKey(database, sid, sourceTable)] = lsn
+}
+
+// copiedOperation reports whether an operation changes rows copied by the full sync:
+// the changes of events tables and the DDL statements are not part of the copy.
+func copiedOperation(op operation) bool {
+	return op.opCode != "" && op.opCode != "ddl" && opCodeFor(TableTypeEvents, op.opCode[:1]) != op.opCode
+}
+
+// fenced reports whether an operation is older than the last resync of its destination table
+// or than the full sync of its source table.
+func fenced(op operation) bool {
+	resyncFences.Lock()
+	defer resyncFences.Unlock()
+	if lsn, ok := resyncFences.m[syncFenceKey(op.database, op.sid, op.syncTable)]; ok && op.lsn < lsn && copiedOperation(op) {
+		return true
+	}
+	lsn, ok := resyncFences.m[op.database+"-"+op.sid+"-"+op.destTable]
+	return ok && op.lsn < lsn
+}
+
+// holdTable holds the changes of a destination table from a source while it is copied from the snapshot at lsn.
+func holdTable(database, sid, destTable string, lsn pglogrepl.LSN) {
+	resyncHolds.Lock()
+	defer resyncHolds.Unlock()
+	resyncHolds.m[database+"-"+sid+"-"+destTable] = &resyncHold{lsn: lsn}
+}
+
+// releaseTable sends the changes held during the copy of a destination table to the workers, in order.
+// New changes of the table wait for the held ones to be sent.
+func releaseTable(database, sid, destTable string) {
+	resyncHolds.Lock()
+	defer resyncHolds.Unlock()
+	key := database + "-" + sid + "-" + destTable
+	hold, ok := resyncHolds.m[key]
+	if !ok {
+		return
+	}
+	delete(resyncHolds.m, key)
+	for _, op := range hold.ops {
+		SendWork(op)
+	}
+}
+
+// held reports whether an operation changes a table being copied. Changes older than the snapshot are
+// part of the copy and skipped, newer changes are held until the copy is done.
+func held(op operation) bool {
+	resyncHolds.Lock()
+	defer resyncHolds.Unlock()
+	hold, ok := resyncHolds.m[op.database+"-"+op.sid+"-"+op.destTable]
+	if !ok {
+		return false
+	}
+	if op.lsn >= hold.lsn {
+		hold.ops = append(hold.ops, op)
+	}
+	return true
+}
+
+// resetHolds forgets the changes held for a source when its replication starts again. The confirmed
+// position of the source stays before the snapshot, so they are received again.
+func resetHolds(database, sid string) {
+	resyncHolds.Lock()
+	defer resyncHolds.Unlock()
+	for key, hold := range resyncHolds.m {
+		if strings.HasPrefix(key, database+"-"+sid+"-") {
+			hold.ops = nil
+		}
+	}
+}
+
+// heldPosition returns the lowest snapshot position of the tables of a source being copied, or 0.
+// The source must not confirm this position before the held changes are committed.
+func heldPosition(database, sid string) pglogrepl.LSN {
+	resyncHolds.Lock()
+	defer resyncHolds.Unlock()
+	lsn := pglogrepl.LSN(0)
+	for key, hold := range resyncHolds.m {
+		if strings.HasPrefix(key, database+"-"+sid+"-") && (lsn == 0 || hold.lsn < lsn) {
+			lsn = hold.lsn
+		}
+	}
+	return lsn
+}
+
+// startResyncJob registers a resync of a mapping entry, it fails if one is already running.
+func startResyncJob(status ResyncStatus) bool {
+	resyncJobs.Lock()
+	defer resyncJobs.Unlock()
+	if resyncJobs.m[status.ID].State == ResyncStateRunning {
+		return false
+	}
+	resyncJobs.m[status.ID] = status
+	return true
+}
+
+func finishResyncJob(id int64, err error) {
+	resyncJobs.Lock()
+	defer resyncJobs.Unlock()
+	status := resyncJobs.m[id]
+	now := time.Now()
+	status.FinishedAt = &now
+	status.State = ResyncStateDone
+	if err != nil {
+		status.State = ResyncStateFailed
+		status.Error = err.Error()
+	}
+	resyncJobs.m[id] = status
+}
+
+func getResyncJob(id int64) (ResyncStatus, bool) {
+	resyncJobs.Lock()
+	defer resyncJobs.Unlock()
+	status, ok := resyncJobs.m[id]
+	return status, ok
+}
+
+func waitURLState(database, sid, state string) error {
+	deadline := time.Now().Add(resyncWaitTimeout)
+	for getURLState(database, sid) != state {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for url state=%s, db-sid=%s-%s", state, database, sid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil
+}
+
+// waitSourceCommitted waits until the workers have committed all the operations they received from a source.
+func waitSourceCommitted(database, sid string) error {
+	deadline := time.Now().Add(resyncWaitTimeout)
+	for {
+		dirty := false
+		for _, status := range GetSourceStatus(database, sid) {
+			if status.WrittenLSN > status.CommittedLSN {
+				dirty = true
+			}
+		}
+		if !dirty {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for workers to commit, db-sid=%s-%s", database, sid)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// createSnapshotSlot creates a temporary replication slot to export a snapshot of the source and
+// get its position. The slot is dropped when the connection is closed.
+func createSnapshotSlot(ctx context.Context, log *slog.Logger, name string, url *SourceURL) (*pgx.Conn, pglogrepl.LSN, string, error) {
+	databaseURL := strings.Split(url.URL, "?")[0] + "?replication=database&application_name=" + name
+	parsedConfig, err := pgx.ParseConfig(databaseURL)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("cannot parse url=%s, error=%w", databaseURL, err)
+	}
+	parsedConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	conn, err := pgx.ConnectConfig(ctx, parsedConfig)
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("cannot start replication connection, error=%w", err)
+	}
+	slotName := strings.ReplaceAll(name+"_"+url.SID, "-", "_")
+	result, err := pglogrepl.CreateReplicationSlot(ctx, conn.PgConn(), slotName, "pgoutput",
+		pglogrepl.CreateReplicationSlotOptions{
+			Temporary:      true,
+			SnapshotAction: "EXPORT_SNAPSHOT",
+			Mode:           pglogrepl.LogicalReplication,
+		})
+	if err != nil {
+		conn.Close(ctx)
+		return nil, 0, "", fmt.Errorf("cannot create temporary replication slot, error=%w", err)
+	}
+	lsn, err := pglogrepl.ParseLSN(result.ConsistentPoint)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, 0, "", fmt.Errorf("cannot parse consistent point=%s: %w", result.ConsistentPoint, err)
+	}
+	log.Debug("Created temporary replication slot", "slotname", slotName, "lsn", lsn, "snapshot", result.SnapshotName)
+	return conn, lsn, result.SnapshotName, nil
+}
+
+// copySourceTable copies a table from a snapshot of a source URL in the destination table or in the shadow table.
+func copySourceTable(log *slog.Logger, database string, url *SourceURL, snapshotName, sourceTable, destTable, into string) error {
+	ctx := context.Background()
+	log = log.With("db-sid", database+"-"+url.SID)
+	conn, err := connectSnapshot(ctx, log, database, url.URL, snapshotName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	chunks, err := planChunks(ctx, log, conn, database, sourceTable, destTable)
+	if err != nil {
+		return err
+	}
+	for i := range chunks {
+		chunks[i].into = into
+		chunks[i].untracked = true
+	}
+	failed, err := copyChunks(log, database, url.SID, url.URL, snapshotName, conn, chunks)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("cannot copy table=%s, failed chunks=%d", sourceTable, failed)
+	}
+	return nil
+}
+
+// swapTable replaces the destination table with the shadow table. When only some sources were copied,
+// the rows of the other sources are moved from the destination table while it is locked.
+func swapTable(ctx context.Context, destTable, shadowTable string, hasSID bool, sids []string, allSIDs bool) error {
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot begin swap transaction, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if _, err = tx.Exec(ctx, fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", destTable)); err != nil {
+		return fmt.Errorf("cannot lock table=%s, error=%w", destTable, err)
+	}
+	if hasSID && !allSIDs {
+		_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE sid <> ALL($1)", shadowTable, destTable), sids)
+		if err != nil {
+			return fmt.Errorf("cannot copy rows of other sources, error=%w", err)
+		}
+	}
+
+	// sequences owned by the destination table are still used by the shadow table defaults
+	rows, err := tx.Query(ctx, `SELECT s.oid::regclass::text, a.attname
+		FROM pg_depend d
+			JOIN pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+			JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE d.refobjid = $1::regclass AND d.deptype = 'a'`, destTable)
+	if err != nil {
+		return fmt.Errorf("cannot get owned sequences, error=%w", err)
+	}
+	sequences, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct {
+		Sequence string
+		Column   string
+	}])
+	if err != nil {
+		return fmt.Errorf("cannot get owned sequences, error=%w", err)
+	}
+	for _, s := range sequences {
+		_, err = tx.Exec(ctx, fmt.Sprintf("ALTER SEQUENCE %s OWNED BY %s.%s", s.Sequence, shadowTable, s.Column))
+		if err != nil {
+			return fmt.Errorf("cannot move sequence=%s, error=%w", s.Sequence, err)
+		}
+	}
+
+	_, table := splitSchema(destTable)
+	oldTable := destTable + "_kvsz_old"
+	_, oldName := splitSchema(oldTable)
+	for _, q := range []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", destTable, oldName),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", shadowTable, table),
+		"DROP TABLE " + oldTable,
+	} {
+		if _, err = tx.Exec(ctx, q); err != nil {
+			return fmt.Errorf("cannot swap tables, query=%s, error=%w", q, err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit swap transaction, error=%w", err)
+	}
+	return nil
+}
+
+// checkSwappable checks that a destination table can be replaced by a shadow table created with
+// LIKE ... INCLUDING ALL: objects depending on the table, foreign keys, triggers and privileges are not copied.
+func checkSwappable(destTable string) error {
+	rows, err := DestConnectionPool.Query(context.Background(), `
+		SELECT pg_describe_object(classid, objid, objsubid) FROM pg_depend
+		WHERE refclassid = 'pg_class'::regclass AND refobjid = $1::regclass AND deptype = 'n'
+		UNION ALL
+		SELECT pg_describe_object('pg_constraint'::regclass, oid, 0) FROM pg_constraint
+		WHERE conrelid = $1::regclass AND contype = 'f'
+		UNION ALL
+		SELECT pg_describe_object('pg_trigger'::regclass, oid, 0) FROM pg_trigger
+		WHERE tgrelid = $1::regclass AND NOT tgisinternal
+		UNION ALL
+		SELECT 'privileges on ' || oid::regclass::text FROM pg_class
+		WHERE oid = $1::regclass AND relacl IS NOT NULL`, destTable)
+	if err != nil {
+		return fmt.Errorf("cannot get dependencies of table=%s, error=%w", destTable, err)
+	}
+	dependencies, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("cannot get dependencies of table=%s, error=%w", destTable, err)
+	}
+	if len(dependencies) > 0 {
+		return fmt.Errorf("table=%s cannot be swapped, use truncate mode, dependencies=%s",
+			destTable, strings.Join(dependencies, ", "))
+	}
+	return nil
+}
+
+// resyncTable copies again a replicated table from some sources of a database.
+// The sources are paused and their pending operations committed, then a snapshot of each source is taken
+// with a temporary replication slot and the destination is prepared. The sources are resumed while the table
+// is copied from the snapshots: the changes of this table older than the snapshot are skipped as they are
+// part of the copy, and the newer ones are held until the copy is done.
+//
+//nolint:funlen,gocognit,cyclop // these are sequential steps
+func resyncTable(log *slog.Logger, entry MappingEntry, database string, urls []*SourceURL, mode string, allSIDs bool) error {
+	ctx := context.Background()
+	sourceTable := joinSchema(entry.Schema, entry.Name)
+	destTable := joinSchema(config.Database.Schema, entry.Target)
+	_, hasSID := DestTables()[destTable].Columns["sid"]
+	sids := make([]string, 0, len(urls))
+	for _, url := range urls {
+		sids = append(sids, url.SID)
+	}
+	log = log.With("sourceTable", sourceTable, "destTable", destTable, "mode", mode, "sids", sids)
+	log.Info("Starting table resync")
+
+	// Pause sources and wait for their operations to be committed
+	var paused []*SourceURL
+	resume := func() {
+		for _, url := range paused {
+			if err := sendURLCommand(url, URLCommandResume); err != nil {
+				log.Error("cannot resume url after resync", "sid", url.SID, "error", err)
+			}
+		}
+		paused = nil
+	}
+	defer resume()
+	for _, url := range urls {
+		if getURLState(database, url.SID) == URLStatePaused {
+			continue
+		}
+		if err := sendURLCommand(url, URLCommandPause); err != nil {
+			return err
+		}
+		paused = append(paused, url)
+		if err := waitURLState(database, url.SID, URLStatePaused); err != nil {
+			return err
+		}
+	}
+	for _, url := range urls {
+		if err := waitSourceCommitted(database, url.SID); err != nil {
+			return err
+		}
+	}
+
+	// Take a snapshot of each source and hold the changes of the table after it
+	snapshots := make([]string, len(urls))
+	fences := make([]pglogrepl.LSN, len(urls))
+	for i, url := range urls {
+		replConn, lsn, snapshotName, err := createSnapshotSlot(ctx, log, "kuvasz_resync_"+database, url)
+		if err != nil {
+			return err
+		}
+		defer replConn.Close(ctx)
+		snapshots[i], fences[i] = snapshotName, lsn
+		holdTable(database, url.SID, destTable, lsn)
+		defer releaseTable(database, url.SID, destTable)
+	}
+
+	// Prepare destination
+	into := ""
+	switch mode {
+	case ResyncModeSwap:
+		into = destTable + "_kvsz_resync"
+		_, err := DestConnectionPool.Exec(ctx, "DROP TABLE IF EXISTS "+into)
+		if err != nil {
+			return fmt.Errorf("cannot drop shadow table, error=%w", err)
+		}
+		_, err = DestConnectionPool.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING ALL)", into, destTable))
+		if err != nil {
+			return fmt.Errorf("cannot create shadow table, error=%w", err)
+		}
+		defer func() {
+			if _, err := DestConnectionPool.Exec(ctx, "DROP TABLE IF EXISTS "+into); err != nil {
+				log.Error("cannot drop shadow table", "table", into, "error", err)
+			}
+		}()
+	default:
+		var err error
+		if hasSID {
+			_, err = DestConnectionPool.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE sid = ANY($1)", destTable), sids)
+		} else {
+			_, err = DestConnectionPool.Exec(ctx, "TRUNCATE "+destTable)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot truncate table=%s, error=%w", destTable, err)
+		}
+	}
+	resume()
+
+	// Copy table from each source
+	for i, url := range urls {
+		if err := copySourceTable(log, database, url, snapshots[i], sourceTable, destTable, into); err != nil {
+			return err
+		}
+	}
+	if mode == ResyncModeSwap {
+		if err := swapTable(ctx, destTable, into, hasSID, sids, allSIDs); err != nil {
+			return err
+		}
+	}
+	for i, url := range urls {
+		setResyncFence(database, url.SID, destTable, fences[i])
+	}
+	log.Info("Finished table resync")
+	return nil
+}
+
+// validateResync checks that a table can be copied again and returns the sources to copy from.
+func validateResync(entry MappingEntry, mode string, sid string) ([]*SourceURL, bool, error) {
+	if !entry.Replicated || entry.Type != TableTypeClone {
+		return nil, false, errors.New("only replicated clone tables can be resynced")
+	}
+	if entry.TargetExpression != "" {
+		return nil, false, errors.New("tables with a target expression cannot be resynced")
+	}
+	if mode != ResyncModeTruncate && mode != ResyncModeSwap {
+		return nil, false, fmt.Errorf("invalid resync mode: %s", mode)
+	}
+	destTable := joinSchema(config.Database.Schema, entry.Target)
+	destination, ok := DestTables()[destTable]
+	if !ok {
+		return nil, false, fmt.Errorf("destination table does not exist, table=%s", destTable)
+	}
+	_, hasSID := destination.Columns["sid"]
+	if mode == ResyncModeSwap {
+		if err := checkSwappable(destTable); err != nil {
+			return nil, false, err
+		}
+	}
+	var urls []*SourceURL
+	for i := range dbmap {
+		if dbmap[i].Name != entry.DBName {
+			continue
+		}
+		for j := range dbmap[i].Urls {
+			if sid == "" || dbmap[i].Urls[j].SID == sid {
+				urls = append(urls, &dbmap[i].Urls[j])
+			}
+		}
+		if len(urls) == 0 {
+			return nil, false, fmt.Errorf("cannot find sid: %s", sid)
+		}
+		allSIDs := len(urls) == len(dbmap[i].Urls)
+		if !hasSID && !allSIDs {
+			return nil, false, errors.New("destination table has no sid column, all sources must be resynced")
+		}
+		return urls, allSIDs, nil
+	}
+	return nil, false, fmt.Errorf("cannot find database: %s", entry.DBName)
+}
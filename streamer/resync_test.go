@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+func TestSyncFence(t *testing.T) {
+	defer func() {
+		resyncFences.Lock()
+		defer resyncFences.Unlock()
+		clear(resyncFences.m)
+	}()
+	// fences are loaded from the sync state with the schema qualified source table
+	setSyncFences("db1", "12", map[string]pglogrepl.LSN{"public.t7": 0x200})
+
+	clone := MappingEntry{DBName: "db1", Schema: "public", Name: "t7", Type: TableTypeClone}
+	events := MappingEntry{DBName: "db1", Schema: "public", Name: "t7", Type: TableTypeEvents}
+	partition := PGRelation{Namespace: "public", RelationName: "t7_2024"}
+	table := PGRelation{Namespace: "public", RelationName: "t7"}
+
+	tests := []struct {
+		name   string
+		sid    string
+		lsn    pglogrepl.LSN
+		entry  MappingEntry
+		rel    PGRelation
+		action string
+		fenced bool
+	}{
+		{"change of the table before the snapshot", "12", 0x100, clone, table, "i", true},
+		{"change of a partition before the snapshot", "12", 0x100, clone, partition, "u", true},
+		{"change after the snapshot", "12", 0x200, clone, table, "d", false},
+		{"change of another source", "13", 0x100, clone, table, "i", false},
+		{"change of an events table", "12", 0x100, events, table, "i", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := operation{database: "db1", sid: tt.sid, lsn: tt.lsn}.forEntry(tt.entry, tt.rel, "public.t7", tt.action)
+			if got := fenced(op); got != tt.fenced {
+				t.Errorf("fenced() = %v, want %v", got, tt.fenced)
+			}
+		})
+	}
+}
+
+func TestResyncHold(t *testing.T) {
+	defer func() {
+		resyncHolds.Lock()
+		defer resyncHolds.Unlock()
+		clear(resyncHolds.m)
+	}()
+	holdTable("db1", "12", "public.t7", 0x200)
+
+	for _, op := range []operation{
+		{database: "db1", sid: "12", destTable: "public.t7", lsn: 0x100},
+		{database: "db1", sid: "12", destTable: "public.t7", lsn: 0x200},
+		{database: "db1", sid: "12", destTable: "public.t7", lsn: 0x300},
+	} {
+		if !held(op) {
+			t.Errorf("held(%s) = false, want true", op.lsn)
+		}
+	}
+	if held(operation{database: "db1", sid: "12", destTable: "public.t8", lsn: 0x300}) {
+		t.Error("change of another table is held")
+	}
+	if held(operation{database: "db1", sid: "13", destTable: "public.t7", lsn: 0x300}) {
+		t.Error("change of another source is held")
+	}
+	if got := len(resyncHolds.m["db1-12-public.t7"].ops); got != 2 {
+		t.Errorf("held operations = %d, want 2", got)
+	}
+	if got := heldPosition("db1", "12"); got != 0x200 {
+		t.Errorf("heldPosition() = %s, want 0/200", got)
+	}
+	if got := heldPosition("db1", "13"); got != 0 {
+		t.Errorf("heldPosition() of another source = %s, want 0", got)
+	}
+
+	// changes are received again from before the snapshot when the source restarts
+	resetHolds("db1", "12")
+	if got := len(resyncHolds.m["db1-12-public.t7"].ops); got != 0 {
+		t.Errorf("held operations after restart = %d, want 0", got)
+	}
+}
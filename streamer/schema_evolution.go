@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// firstNormalOID is the first OID assigned to user defined objects.
+// Types with lower OIDs are built in and have the same OID in all databases.
+const firstNormalOID = 16384
+
+// widerTypes lists the types a column can be changed to without losing values.
+var widerTypes = map[uint32][]uint32{
+	pgtype.Int2OID:    {pgtype.Int4OID, pgtype.Int8OID, pgtype.NumericOID},
+	pgtype.Int4OID:    {pgtype.Int8OID, pgtype.NumericOID},
+	pgtype.Int8OID:    {pgtype.NumericOID},
+	pgtype.Float4OID:  {pgtype.Float8OID},
+	pgtype.VarcharOID: {pgtype.TextOID},
+	pgtype.BPCharOID:  {pgtype.TextOID},
+}
+
+// numericPrecision returns the precision and scale of a numeric type modifier.
+func numericPrecision(typeModifier int32) (int32, int32) {
+	return ((typeModifier - 4) >> 16) & 0xffff, (typeModifier - 4) & 0xffff
+}
+
+// widens checks that a column type can be changed to another type without losing values.
+// A type modifier of -1 means an unconstrained length or precision.
+func widens(fromOID uint32, fromModifier int32, toOID uint32, toModifier int32) bool {
+	if fromOID != toOID {
+		if toOID == pgtype.NumericOID && toModifier != -1 {
+			return false
+		}
+		return slices.Contains(widerTypes[fromOID], toOID)
+	}
+	if fromModifier == toModifier || toModifier == -1 {
+		return fromModifier != toModifier
+	}
+	if fromModifier == -1 {
+		return false
+	}
+	switch fromOID {
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		return toModifier > fromModifier
+	case pgtype.NumericOID:
+		fromPrecision, fromScale := numericPrecision(fromModifier)
+		toPrecision, toScale := numericPrecision(toModifier)
+		return toScale >= fromScale && toPrecision-toScale >= fromPrecision-fromScale
+	default:
+		return false
+	}
+}
+
+// formatType returns the SQL name of a built in type with its modifier, for example varchar(20).
+func formatType(ctx context.Context, oid uint32, typeModifier int32) (string, error) {
+	var name string
+	err := DestConnectionPool.QueryRow(ctx, "SELECT format_type($1, $2)", oid, typeModifier).Scan(&name)
+	if err != nil {
+		return "", fmt.Errorf("cannot format type, oid=%d, error=%w", oid, err)
+	}
+	return name, nil
+}
+
+// destColumnTypes returns the types and type modifiers of the columns of a destination table.
+func destColumnTypes(ctx context.Context, table string) (map[string]PGColumn, error) {
+	result := make(map[string]PGColumn)
+	rows, err := DestConnectionPool.Query(ctx,
+		"SELECT attname, atttypid, atttypmod FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped",
+		table)
+	if err != nil {
+		return result, fmt.Errorf("cannot read column types, table=%s, error=%w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c PGColumn
+		if err = rows.Scan(&c.Name, &c.DataTypeOID, &c.TypeModifier); err != nil {
+			return result, fmt.Errorf("cannot scan column type, table=%s, error=%w", table, err)
+		}
+		result[c.Name] = c
+	}
+	if err = rows.Err(); err != nil {
+		return result, fmt.Errorf("cannot read column types, table=%s, error=%w", table, err)
+	}
+	return result, nil
+}
+
+// evolveTable returns the statements adding the columns of a source relation missing in a destination table.
+// With full schema evolution, the types of existing columns are also widened to the source types.
+func evolveTable(ctx context.Context, log *slog.Logger, table string, rel PGRelation, mode string) ([]string, error) {
+	destination, ok := DestTables()[table]
+	if !ok {
+		return nil, fmt.Errorf("destination table does not exist, table=%s", table)
+	}
+	var current map[string]PGColumn
+	if mode == SchemaEvolutionFull {
+		var err error
+		current, err = destColumnTypes(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var queries []string
+	for _, c := range rel.Columns {
+		_, exists := destination.Columns[c.Name]
+		if exists && (mode != SchemaEvolutionFull || !widens(current[c.Name].DataTypeOID, current[c.Name].TypeModifier, c.DataTypeOID, c.TypeModifier)) {
+			continue
+		}
+		if c.DataTypeOID >= firstNormalOID {
+			log.Warn("Cannot evolve column with a user defined type", "table", table, "column", c.Name, "oid", c.DataTypeOID)
+			continue
+		}
+		columnType, err := formatType(ctx, c.DataTypeOID, c.TypeModifier)
+		if err != nil {
+			return nil, err
+		}
+		name := pgx.Identifier{c.Name}.Sanitize()
+		query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, name, columnType)
+		if exists {
+			query = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s", table, name, columnType)
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// evolveSchema dispatches the changes of a source relation to the destination tables of the entries
+// with schema evolution as DDL operations. They are applied in stream order like replicated DDL:
+// committed before the following changes and before the destination metadata is refreshed.
+// Destinations computed by set or target expressions and events tables are not evolved.
+func evolveSchema(log *slog.Logger, op operation, rel PGRelation, state *replicationState) error {
+	entries, err := MappingTable().FindAllByName(op.database, joinSchema(rel.Namespace, rel.RelationName))
+	if err != nil {
+		return nil
+	}
+	ctx := context.Background()
+	for _, entry := range entries {
+		if entry.SchemaEvolution == "" || entry.Type == TableTypeEvents || entry.compiledTarget != nil || len(entry.compiledSet) > 0 {
+			continue
+		}
+		tables := []string{entry.destTable()}
+		if entry.Type == TableTypeHistory4 {
+			tables = append(tables, historyTableName(entry.destTable()))
+		}
+		mapped := entry.mapRelation(rel)
+		for _, table := range tables {
+			queries, err := evolveTable(ctx, log, table, mapped, entry.SchemaEvolution)
+			if err != nil {
+				return fmt.Errorf("cannot evolve destination table=%s, error=%w", table, err)
+			}
+			for _, query := range queries {
+				ddlOp := op.forEntry(entry, rel, table, "")
+				ddlOp.opCode = "ddl"
+				ddlOp.statement = query
+				log.Info("Evolving destination table", "query", query)
+				state.dispatch(ddlOp)
+			}
+		}
+	}
+	return nil
+}
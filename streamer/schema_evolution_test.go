@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// numericModifier returns the type modifier of numeric(precision, scale).
+func numericModifier(precision int32, scale int32) int32 {
+	return (precision<<16 | scale) + 4
+}
+
+// varcharModifier returns the type modifier of varchar(length).
+func varcharModifier(length int32) int32 {
+	return length + 4
+}
+
+func TestNumericPrecision(t *testing.T) {
+	precision, scale := numericPrecision(numericModifier(12, 3))
+	if precision != 12 || scale != 3 {
+		t.Errorf("numeric(12,3) decoded as numeric(%d,%d)", precision, scale)
+	}
+}
+
+func TestWidens(t *testing.T) {
+	tests := []struct {
+		name         string
+		fromOID      uint32
+		fromModifier int32
+		toOID        uint32
+		toModifier   int32
+		want         bool
+	}{
+		{"int4 to int8", pgtype.Int4OID, -1, pgtype.Int8OID, -1, true},
+		{"int2 to numeric", pgtype.Int2OID, -1, pgtype.NumericOID, -1, true},
+		{"int8 to int4", pgtype.Int8OID, -1, pgtype.Int4OID, -1, false},
+		{"int4 to numeric(10,0)", pgtype.Int4OID, -1, pgtype.NumericOID, numericModifier(10, 0), false},
+		{"float4 to float8", pgtype.Float4OID, -1, pgtype.Float8OID, -1, true},
+		{"varchar to text", pgtype.VarcharOID, varcharModifier(20), pgtype.TextOID, -1, true},
+		{"text to varchar", pgtype.TextOID, -1, pgtype.VarcharOID, varcharModifier(20), false},
+		{"int4 to text", pgtype.Int4OID, -1, pgtype.TextOID, -1, false},
+		{"same type", pgtype.Int4OID, -1, pgtype.Int4OID, -1, false},
+		{"varchar(20) to varchar(40)", pgtype.VarcharOID, varcharModifier(20), pgtype.VarcharOID, varcharModifier(40), true},
+		{"varchar(40) to varchar(20)", pgtype.VarcharOID, varcharModifier(40), pgtype.VarcharOID, varcharModifier(20), false},
+		{"varchar(20) to varchar", pgtype.VarcharOID, varcharModifier(20), pgtype.VarcharOID, -1, true},
+		{"varchar to varchar(20)", pgtype.VarcharOID, -1, pgtype.VarcharOID, varcharModifier(20), false},
+		{"bpchar(2) to bpchar(4)", pgtype.BPCharOID, varcharModifier(2), pgtype.BPCharOID, varcharModifier(4), true},
+		{"numeric(10,2) to numeric(12,2)", pgtype.NumericOID, numericModifier(10, 2), pgtype.NumericOID, numericModifier(12, 2), true},
+		{"numeric(10,2) to numeric(12,4)", pgtype.NumericOID, numericModifier(10, 2), pgtype.NumericOID, numericModifier(12, 4), true},
+		{"numeric(10,2) to numeric(10,4)", pgtype.NumericOID, numericModifier(10, 2), pgtype.NumericOID, numericModifier(10, 4), false},
+		{"numeric(10,2) to numeric(8,0)", pgtype.NumericOID, numericModifier(10, 2), pgtype.NumericOID, numericModifier(8, 0), false},
+		{"numeric(10,2) to numeric", pgtype.NumericOID, numericModifier(10, 2), pgtype.NumericOID, -1, true},
+		{"timestamp(3) to timestamp(6)", pgtype.TimestampOID, 3, pgtype.TimestampOID, 6, false},
+	}
+	for _, tt := range tests {
+		if got := widens(tt.fromOID, tt.fromModifier, tt.toOID, tt.toModifier); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
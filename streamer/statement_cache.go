@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// statementCacheCapacity is the number of clone statements kept prepared on each destination connection.
+const statementCacheCapacity = 256
+
+type (
+	// preparedStatement is a clone statement prepared on a connection.
+	preparedStatement struct {
+		key  string
+		name string
+	}
+
+	// connStatements are the clone statements prepared on a destination connection, the most
+	// recently used first. Statements built from previous destination metadata or evicted when
+	// the cache is full are released by trim, once they are no longer queued in a batch.
+	connStatements struct {
+		generation int
+		next       int
+		lru        *list.List
+		keys       map[string]*list.Element
+		released   []string
+	}
+)
+
+// statementCache holds the statements prepared on each destination connection. The generation is
+// incremented when the destination metadata is refreshed, as the statements may not match it anymore.
+var statementCache = struct {
+	sync.Mutex
+	generation  int
+	connections map[*pgx.Conn]*connStatements
+}{
+	connections: make(map[*pgx.Conn]*connStatements),
+}
+
+// invalidateStatements releases the statements built from the previous destination metadata.
+func invalidateStatements() {
+	statementCache.Lock()
+	defer statementCache.Unlock()
+	statementCache.generation++
+}
+
+// forgetConnection removes a closed connection from the cache.
+func forgetConnection(conn *pgx.Conn) {
+	statementCache.Lock()
+	defer statementCache.Unlock()
+	delete(statementCache.connections, conn)
+}
+
+// connectionStatements returns the statements prepared on a connection for the current destination metadata.
+// A connection is only used by one worker at a time, so its statements are not locked.
+func connectionStatements(conn *pgx.Conn) *connStatements {
+	statementCache.Lock()
+	defer statementCache.Unlock()
+	c, ok := statementCache.connections[conn]
+	if !ok {
+		c = &connStatements{lru: list.New(), keys: make(map[string]*list.Element)}
+		statementCache.connections[conn] = c
+	}
+	if c.generation != statementCache.generation {
+		for e := c.lru.Front(); e != nil; e = e.Next() {
+			c.released = append(c.released, e.Value.(preparedStatement).name)
+		}
+		c.lru.Init()
+		clear(c.keys)
+		c.generation = statementCache.generation
+	}
+	return c
+}
+
+// prepareStatement returns the name of the clone statement of a key prepared on the connection of a transaction.
+// It is prepared on first use of the key on the connection.
+func prepareStatement(ctx context.Context, tx pgx.Tx, q cloneQuery) (string, error) {
+	c := connectionStatements(tx.Conn())
+	if e, ok := c.keys[q.key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(preparedStatement).name, nil
+	}
+	name := fmt.Sprintf("kvsz_%d_%d", c.generation, c.next)
+	if _, err := tx.Conn().Prepare(ctx, name, q.sql); err != nil {
+		return "", fmt.Errorf("cannot prepare statement=%s, error=%w", q.sql, err)
+	}
+	c.next++
+	c.keys[q.key] = c.lru.PushFront(preparedStatement{key: q.key, name: name})
+	log.Debug("Prepared statement", "name", name, "key", q.key, "sql", q.sql)
+	return name, nil
+}
+
+// trimStatements releases the statements of a connection that are outdated or beyond the capacity
+// of the cache. It must be called when no batch is pending and the transaction is not aborted.
+func trimStatements(ctx context.Context, conn *pgx.Conn) {
+	c := connectionStatements(conn)
+	for c.lru.Len() > statementCacheCapacity {
+		e := c.lru.Back()
+		s := c.lru.Remove(e).(preparedStatement)
+		delete(c.keys, s.key)
+		c.released = append(c.released, s.name)
+	}
+	for len(c.released) > 0 {
+		name := c.released[len(c.released)-1]
+		if err := conn.Deallocate(ctx, name); err != nil {
+			log.Warn("Cannot deallocate statement", "name", name, "error", err)
+			return
+		}
+		c.released = c.released[:len(c.released)-1]
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestStatementCacheGeneration(t *testing.T) {
+	conn := &pgx.Conn{}
+	defer forgetConnection(conn)
+
+	c := connectionStatements(conn)
+	for _, key := range []string{"ic public.t1 id,name", "dc public.t1 id=$"} {
+		c.keys[key] = c.lru.PushFront(preparedStatement{key: key, name: "kvsz_test_" + key})
+	}
+	if connectionStatements(conn).lru.Len() != 2 {
+		t.Fatalf("statements of the current metadata were released")
+	}
+
+	// refreshing the destination metadata releases all the statements of the connection
+	setDestTables(DestTables())
+	c = connectionStatements(conn)
+	if c.lru.Len() != 0 || len(c.keys) != 0 {
+		t.Errorf("statements of the previous metadata are still cached: %d", c.lru.Len())
+	}
+	slices.Sort(c.released)
+	want := []string{"kvsz_test_dc public.t1 id=$", "kvsz_test_ic public.t1 id,name"}
+	if !slices.Equal(c.released, want) {
+		t.Errorf("released = %v, want %v", c.released, want)
+	}
+	if c.generation != statementCache.generation {
+		t.Errorf("generation = %d, want %d", c.generation, statementCache.generation)
+	}
+}
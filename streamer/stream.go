@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/jackc/pglogrepl"
+)
+
+type (
+	// streamRecord is a change of a streamed in-progress transaction kept in wire format.
+	// xid is the (sub)transaction that generated the change.
+	streamRecord struct {
+		xid  uint32
+		data []byte
+	}
+
+	// streamBuffer accumulates the changes of a streamed transaction until it is committed or aborted.
+	// Changes are kept in memory and spilled to a temporary file once they exceed app.stream_buffer_size.
+	streamBuffer struct {
+		xid     uint32
+		records []streamRecord
+		size    int
+		file    *os.File
+		writer  *bufio.Writer
+		aborted map[uint32]bool
+	}
+
+	// streamBuffers holds the buffers of all open streamed transactions, indexed by top level xid.
+	streamBuffers map[uint32]*streamBuffer
+)
+
+// streamedChangeXid returns the (sub)transaction of a change received within a stream.
+// Only changes that must wait for the end of the transaction are reported.
+// Relation messages describe the tables as of the streamed transaction, they are applied at its commit.
+// The source sends them once per top level transaction, so they are kept when a subtransaction aborts.
+func streamedChangeXid(msg pglogrepl.Message, topXid uint32) (uint32, bool) {
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessageV2:
+		return topXid, true
+	case *pglogrepl.InsertMessageV2:
+		return m.Xid, true
+	case *pglogrepl.UpdateMessageV2:
+		return m.Xid, true
+	case *pglogrepl.DeleteMessageV2:
+		return m.Xid, true
+	case *pglogrepl.TruncateMessageV2:
+		return m.Xid, true
+	case *pglogrepl.LogicalDecodingMessageV2:
+		return m.Xid, m.Transactional
+	}
+	return 0, false
+}
+
+func (b *streamBuffer) spill() error {
+	file, err := os.CreateTemp(config.App.SpillDirectory, "kuvasz-stream-*")
+	if err != nil {
+		return fmt.Errorf("cannot create spill file, error=%w", err)
+	}
+	log.Debug("Spilling streamed transaction to disk", "xid", b.xid, "file", file.Name(), "size", b.size)
+	b.file = file
+	b.writer = bufio.NewWriter(file)
+	for _, r := range b.records {
+		if err = b.write(r); err != nil {
+			return err
+		}
+	}
+	b.records = nil
+	return nil
+}
+
+func (b *streamBuffer) write(r streamRecord) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], r.xid)
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(r.data))) //nolint:gosec // messages are smaller than 4GB
+	if _, err := b.writer.Write(header[:]); err != nil {
+		return fmt.Errorf("cannot write spill file, error=%w", err)
+	}
+	if _, err := b.writer.Write(r.data); err != nil {
+		return fmt.Errorf("cannot write spill file, error=%w", err)
+	}
+	return nil
+}
+
+func (b *streamBuffer) add(xid uint32, data []byte) error {
+	r := streamRecord{xid: xid, data: slices.Clone(data)}
+	b.size += len(data)
+	if b.file != nil {
+		return b.write(r)
+	}
+	b.records = append(b.records, r)
+	if b.size > config.App.StreamBufferSize {
+		return b.spill()
+	}
+	return nil
+}
+
+// replay calls apply for each change in order, skipping changes of aborted subtransactions.
+func (b *streamBuffer) replay(apply func(data []byte) error) error {
+	if b.file != nil {
+		if err := b.writer.Flush(); err != nil {
+			return fmt.Errorf("cannot flush spill file, error=%w", err)
+		}
+		if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("cannot rewind spill file, error=%w", err)
+		}
+		reader := bufio.NewReader(b.file)
+		var header [8]byte
+		for {
+			_, err := io.ReadFull(reader, header[:])
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("cannot read spill file, error=%w", err)
+			}
+			data := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+			if _, err = io.ReadFull(reader, data); err != nil {
+				return fmt.Errorf("cannot read spill file, error=%w", err)
+			}
+			if b.aborted[binary.BigEndian.Uint32(header[0:4])] {
+				continue
+			}
+			if err = apply(data); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range b.records {
+		if b.aborted[r.xid] {
+			continue
+		}
+		if err := apply(r.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *streamBuffer) close() {
+	b.records = nil
+	if b.file == nil {
+		return
+	}
+	b.file.Close()
+	if err := os.Remove(b.file.Name()); err != nil {
+		log.Error("cannot remove spill file", "file", b.file.Name(), "error", err)
+	}
+	b.file = nil
+}
+
+func (s streamBuffers) add(topXid uint32, xid uint32, data []byte) error {
+	b, ok := s[topXid]
+	if !ok {
+		b = &streamBuffer{xid: topXid, aborted: make(map[uint32]bool)}
+		s[topXid] = b
+	}
+	return b.add(xid, data)
+}
+
+// abort discards a whole streamed transaction or only the changes of one of its subtransactions.
+func (s streamBuffers) abort(log *slog.Logger, topXid uint32, subXid uint32) {
+	b, ok := s[topXid]
+	if !ok {
+		log.Debug("Aborted streamed transaction has no buffered changes", "xid", topXid, "subxid", subXid)
+		return
+	}
+	if topXid != subXid {
+		log.Debug("Discarding streamed subtransaction", "xid", topXid, "subxid", subXid)
+		b.aborted[subXid] = true
+		return
+	}
+	log.Debug("Discarding streamed transaction", "xid", topXid, "size", b.size)
+	b.close()
+	delete(s, topXid)
+}
+
+// commit replays the changes of a streamed transaction and releases its buffer.
+func (s streamBuffers) commit(topXid uint32, apply func(data []byte) error) error {
+	b, ok := s[topXid]
+	if !ok {
+		return nil
+	}
+	defer delete(s, topXid)
+	defer b.close()
+	return b.replay(apply)
+}
+
+func (s streamBuffers) close() {
+	for xid, b := range s {
+		b.close()
+		delete(s, xid)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// replayed commits a streamed transaction and returns the changes applied.
+func replayed(t *testing.T, s streamBuffers, topXid uint32) []string {
+	t.Helper()
+	var result []string
+	err := s.commit(topXid, func(data []byte) error {
+		result = append(result, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("commit failed, error=%v", err)
+	}
+	return result
+}
+
+// testStreamBuffers buffers two streamed transactions, aborts a subtransaction of the first one
+// and the second one, then checks the changes replayed at commit. buffered is called once all
+// changes are added.
+func testStreamBuffers(t *testing.T, buffered func(s streamBuffers)) {
+	t.Helper()
+	s := make(streamBuffers)
+	defer s.close()
+	for _, c := range []struct {
+		topXid uint32
+		xid    uint32
+		data   string
+	}{
+		{100, 100, "a"},
+		{100, 101, "b"},
+		{200, 200, "x"},
+		{100, 102, "c"},
+		{100, 100, "d"},
+	} {
+		if err := s.add(c.topXid, c.xid, []byte(c.data)); err != nil {
+			t.Fatalf("add failed, error=%v", err)
+		}
+	}
+	buffered(s)
+
+	// aborting a subtransaction drops only its changes
+	s.abort(log, 100, 101)
+	if got, want := replayed(t, s, 100), []string{"a", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("commit replayed %v, want %v", got, want)
+	}
+	if _, ok := s[100]; ok {
+		t.Error("committed transaction is still buffered")
+	}
+
+	// aborting the top level transaction drops everything
+	s.abort(log, 200, 200)
+	if _, ok := s[200]; ok {
+		t.Error("aborted transaction is still buffered")
+	}
+	if got := replayed(t, s, 200); len(got) != 0 {
+		t.Errorf("aborted transaction replayed %v", got)
+	}
+}
+
+func TestStreamBuffers(t *testing.T) {
+	testStreamBuffers(t, func(s streamBuffers) {
+		for xid, b := range s {
+			if b.file != nil {
+				t.Errorf("transaction %d spilled to disk", xid)
+			}
+		}
+	})
+}
+
+func TestStreamBuffersSpill(t *testing.T) {
+	dir := t.TempDir()
+	size, directory := config.App.StreamBufferSize, config.App.SpillDirectory
+	config.App.StreamBufferSize, config.App.SpillDirectory = 0, dir
+	defer func() { config.App.StreamBufferSize, config.App.SpillDirectory = size, directory }()
+
+	testStreamBuffers(t, func(streamBuffers) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Errorf("got %d spill files, want 2", len(files))
+		}
+	})
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d spill files left", len(files))
+	}
+}
+
+func inStream(xid uint32) pglogrepl.InStreamMessageV2WithXid {
+	return pglogrepl.InStreamMessageV2WithXid{Xid: xid}
+}
+
+func TestStreamedChangeXid(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      pglogrepl.Message
+		xid      uint32
+		buffered bool
+	}{
+		{"relation", &pglogrepl.RelationMessageV2{InStreamMessageV2WithXid: inStream(0)}, 100, true},
+		{"insert", &pglogrepl.InsertMessageV2{InStreamMessageV2WithXid: inStream(101)}, 101, true},
+		{
+			"transactional message",
+			&pglogrepl.LogicalDecodingMessageV2{
+				LogicalDecodingMessage:   pglogrepl.LogicalDecodingMessage{Transactional: true},
+				InStreamMessageV2WithXid: inStream(102),
+			},
+			102, true,
+		},
+		{"non transactional message", &pglogrepl.LogicalDecodingMessageV2{InStreamMessageV2WithXid: inStream(102)}, 102, false},
+		{"stream stop", &pglogrepl.StreamStopMessageV2{}, 0, false},
+	}
+	for _, tt := range tests {
+		xid, buffered := streamedChangeXid(tt.msg, 100)
+		if buffered != tt.buffered || (buffered && xid != tt.xid) {
+			t.Errorf("%s: got xid=%d, buffered=%t, want xid=%d, buffered=%t", tt.name, xid, buffered, tt.xid, tt.buffered)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	syncStateTable = "kvsz_sync_state"
+
+	// full sync states of a table chunk.
+	SyncStatePending    = "pending"
+	SyncStateInProgress = "in-progress"
+	SyncStateDone       = "done"
+
+	// chunk number of a table waiting to be split in chunks.
+	unplannedChunk = -1
+)
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+func syncStateTableName() string {
+	return joinSchema(config.Database.Schema, syncStateTable)
+}
+
+func createSyncStateTable(conn *pgx.Conn) error {
+	_, err := conn.Exec(context.Background(), fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		database text NOT NULL,
+		sid text NOT NULL,
+		source_table text NOT NULL,
+		chunk integer NOT NULL,
+		chunks integer NOT NULL,
+		dest_table text NOT NULL,
+		source text NOT NULL,
+		condition text NOT NULL,
+		state text NOT NULL,
+		snapshot_lsn pg_lsn,
+		updated_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (database, sid, source_table, chunk))`, syncStateTableName()))
+	if err != nil {
+		return fmt.Errorf("cannot create sync state table, error=%w", err)
+	}
+	return nil
+}
+
+// markTablesPending records that tables must be synced before they are synced, so that a sync
+// interrupted by a crash is resumed on restart. With reset, the state of all tables of the source is cleared.
+func markTablesPending(ctx context.Context, db string, sid string, sourceTables SourceTables, tables []string, reset bool) error {
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot begin sync state transaction, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	if reset {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE database=$1 AND sid=$2", syncStateTableName()), db, sid)
+		if err != nil {
+			return fmt.Errorf("cannot reset sync state, error=%w", err)
+		}
+	}
+	for _, table := range tables {
+		destTable, err := sourceTables.GetTable(table)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE database=$1 AND sid=$2 AND source_table=$3", syncStateTableName()),
+			db, sid, table)
+		if err != nil {
+			return fmt.Errorf("cannot reset sync state, table=%s, error=%w", table, err)
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (database, sid, source_table, chunk, chunks, dest_table, source, condition, state)
+			VALUES ($1, $2, $3, $4, 0, $5, $3, '', $6)`, syncStateTableName()),
+			db, sid, table, unplannedChunk, destTable, SyncStatePending)
+		if err != nil {
+			return fmt.Errorf("cannot mark table pending, table=%s, error=%w", table, err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit sync state, error=%w", err)
+	}
+	return nil
+}
+
+// saveChunks replaces the pending marker of a table with its chunks.
+func saveChunks(ctx context.Context, db string, sid string, table string, chunks []syncChunk) error {
+	tx, err := DestConnectionPool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot begin sync state transaction, error=%w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+	_, err = tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE database=$1 AND sid=$2 AND source_table=$3", syncStateTableName()),
+		db, sid, table)
+	if err != nil {
+		return fmt.Errorf("cannot reset sync state, table=%s, error=%w", table, err)
+	}
+	for _, chunk := range chunks {
+		_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (database, sid, source_table, chunk, chunks, dest_table, source, condition, state)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, syncStateTableName()),
+			db, sid, table, chunk.index, chunk.count, chunk.destTable, chunk.from, chunk.where, SyncStatePending)
+		if err != nil {
+			return fmt.Errorf("cannot save chunk, table=%s, chunk=%d, error=%w", table, chunk.index, err)
+		}
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("cannot commit sync state, error=%w", err)
+	}
+	return nil
+}
+
+// setChunkState updates the state of a chunk. The done state is set in the transaction
+// of the COPY writing the chunk, so that a chunk is either done and fully written or not written at all.
+// The snapshot position of a chunk copied after streaming started is recorded with its state.
+func setChunkState(ctx context.Context, e execer, db string, sid string, chunk syncChunk, state string) error {
+	if chunk.untracked {
+		return nil
+	}
+	var snapshotLSN any
+	if chunk.snapshotLSN != 0 {
+		snapshotLSN = chunk.snapshotLSN.String()
+	}
+	_, err := e.Exec(ctx,
+		fmt.Sprintf(`UPDATE %s SET state=$5, snapshot_lsn=$6, updated_at=now()
+		WHERE database=$1 AND sid=$2 AND source_table=$3 AND chunk=$4`, syncStateTableName()),
+		db, sid, chunk.sourceTable, chunk.index, state, snapshotLSN)
+	if err != nil {
+		return fmt.Errorf("cannot update sync state, table=%s, chunk=%d, error=%w", chunk.sourceTable, chunk.index, err)
+	}
+	return nil
+}
+
+// loadSyncFences returns the snapshot position of the tables of a source fully copied after streaming started.
+func loadSyncFences(ctx context.Context, db string, sid string) (map[string]pglogrepl.LSN, error) {
+	result := make(map[string]pglogrepl.LSN)
+	rows, err := DestConnectionPool.Query(ctx,
+		fmt.Sprintf(`SELECT source_table, max(snapshot_lsn)::text
+		FROM %s
+		WHERE database=$1 AND sid=$2
+		GROUP BY source_table
+		HAVING bool_and(state=$3) AND max(snapshot_lsn) IS NOT NULL`, syncStateTableName()),
+		db, sid, SyncStateDone)
+	if err != nil {
+		return result, fmt.Errorf("cannot read sync fences, error=%w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, position string
+		if err = rows.Scan(&table, &position); err != nil {
+			return result, fmt.Errorf("cannot scan sync fence, error=%w", err)
+		}
+		lsn, err := pglogrepl.ParseLSN(position)
+		if err != nil {
+			return result, fmt.Errorf("cannot parse sync fence=%s, error=%w", position, err)
+		}
+		result[table] = lsn
+	}
+	if err = rows.Err(); err != nil {
+		return result, fmt.Errorf("cannot read sync fences, error=%w", err)
+	}
+	return result, nil
+}
+
+// loadUnfinishedChunks returns the chunks of a source that are not done, indexed by source table.
+// Tables that were not split yet are returned without chunks.
+func loadUnfinishedChunks(ctx context.Context, db string, sid string) (map[string][]syncChunk, error) {
+	result := make(map[string][]syncChunk)
+	rows, err := DestConnectionPool.Query(ctx,
+		fmt.Sprintf(`SELECT source_table, chunk, chunks, dest_table, source, condition
+		FROM %s
+		WHERE database=$1 AND sid=$2 AND state<>$3
+		ORDER BY source_table, chunk`, syncStateTableName()),
+		db, sid, SyncStateDone)
+	if err != nil {
+		return result, fmt.Errorf("cannot read sync state, error=%w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chunk syncChunk
+		err = rows.Scan(&chunk.sourceTable, &chunk.index, &chunk.count, &chunk.destTable, &chunk.from, &chunk.where)
+		if err != nil {
+			return result, fmt.Errorf("cannot scan sync state, error=%w", err)
+		}
+		if chunk.index == unplannedChunk {
+			result[chunk.sourceTable] = nil
+			continue
+		}
+		result[chunk.sourceTable] = append(result[chunk.sourceTable], chunk)
+	}
+	if err = rows.Err(); err != nil {
+		return result, fmt.Errorf("cannot read sync state, error=%w", err)
+	}
+	return result, nil
+}
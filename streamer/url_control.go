@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// commands sent to the replication goroutine of a source URL.
+	URLCommandRestart = "restart"
+	URLCommandPause   = "pause"
+	URLCommandResume  = "resume"
+
+	// replication states of a source URL.
+	URLStateRunning = "running"
+	URLStatePaused  = "paused"
+	URLStateError   = "error"
+
+	urlCommandTimeout = 5 * time.Second
+)
+
+var (
+	errRestart = errors.New("restart requested")
+	errPause   = errors.New("pause requested")
+
+	urlStates = struct {
+		sync.Mutex
+		m map[string]string
+	}{m: make(map[string]string)}
+)
+
+func setURLState(database, sid, state string) {
+	urlStates.Lock()
+	defer urlStates.Unlock()
+	urlStates.m[database+"-"+sid] = state
+}
+
+func getURLState(database, sid string) string {
+	urlStates.Lock()
+	defer urlStates.Unlock()
+	return urlStates.m[database+"-"+sid]
+}
+
+// findSourceURL returns the running source URL with the given id and the name of its database.
+func findSourceURL(id int64) (string, *SourceURL) {
+	for i := range dbmap {
+		for j := range dbmap[i].Urls {
+			if dbmap[i].Urls[j].ID == id {
+				return dbmap[i].Name, &dbmap[i].Urls[j]
+			}
+		}
+	}
+	return "", nil
+}
+
+// findURLBySID returns the running source URL of a database and sid joined as db-sid.
+func findURLBySID(dbsid string) *SourceURL {
+	for i := range dbmap {
+		for j := range dbmap[i].Urls {
+			if dbmap[i].Name+"-"+dbmap[i].Urls[j].SID == dbsid {
+				return &dbmap[i].Urls[j]
+			}
+		}
+	}
+	return nil
+}
+
+// sendURLCommand sends a command to the replication goroutine of a source URL.
+func sendURLCommand(url *SourceURL, command string) error {
+	if url.commandChannel == nil {
+		return errors.New("replication is not started")
+	}
+	select {
+	case url.commandChannel <- command:
+		return nil
+	case <-time.After(urlCommandTimeout):
+		return fmt.Errorf("replication did not accept command %s", command)
+	}
+}
+
+// commandError translates a command received while replicating into the cause of the interruption.
+// resume is ignored as the replication is already running.
+func commandError(command string) error {
+	switch command {
+	case URLCommandRestart:
+		return errRestart
+	case URLCommandPause:
+		return errPause
+	default:
+		return nil
+	}
+}
+
+// waitResume blocks a paused source until it is resumed or restarted.
+// It returns false if the streamer is stopping.
+func waitResume(rootContext context.Context, url *SourceURL) bool {
+	for {
+		select {
+		case command := <-url.commandChannel:
+			if command == URLCommandResume || command == URLCommandRestart {
+				return true
+			}
+		case <-rootContext.Done():
+			return false
+		}
+	}
+}
+
+// waitRetry waits before restarting a failed replication. A command interrupts the wait.
+// It returns false if the streamer is stopping.
+func waitRetry(rootContext context.Context, database string, url *SourceURL, delay time.Duration) bool {
+	select {
+	case command := <-url.commandChannel:
+		if command == URLCommandPause {
+			setURLState(database, url.SID, URLStatePaused)
+			return waitResume(rootContext, url)
+		}
+		return true
+	case <-time.After(delay):
+		return true
+	case <-rootContext.Done():
+		return false
+	}
+}
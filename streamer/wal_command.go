@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// commands received in the replication stream.
+	WALCommandResync     = "resync"
+	WALCommandCheckpoint = "checkpoint"
+	WALCommandPause      = "pause"
+
+	checkpointTable = "kvsz_checkpoint"
+)
+
+func checkpointTableName() string {
+	return joinSchema(config.Database.Schema, checkpointTable)
+}
+
+func createCheckpointTable(conn *pgx.Conn) error {
+	_, err := conn.Exec(context.Background(), fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		database text NOT NULL,
+		sid text NOT NULL,
+		label text NOT NULL,
+		lsn pg_lsn NOT NULL,
+		commit_time timestamptz NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY (database, sid, lsn, label))`, checkpointTableName()))
+	if err != nil {
+		return fmt.Errorf("cannot create checkpoint table, error=%w", err)
+	}
+	return nil
+}
+
+// runCommands runs the commands received in a source transaction once all its changes are sent
+// to the workers. The commands that need it first wait for the changes to be committed
+// in the destination, so that they act at the exact position of the command in the stream.
+// It returns errPause when the replication must be paused after the transaction.
+func (state *replicationState) runCommands(log *slog.Logger, database string, sid string) error {
+	commands := state.commands
+	state.commands = nil
+	pause := false
+	for _, command := range commands {
+		name, argument, _ := strings.Cut(strings.TrimSpace(command), " ")
+		argument = strings.TrimSpace(argument)
+		log := log.With("command", name, "argument", argument, "lsn", state.committedTransactionLSN)
+		log.Info("Running command")
+		if name == WALCommandCheckpoint || name == WALCommandResync || name == WALCommandPause {
+			// the changes before the command must be committed, otherwise it is received again after the restart
+			if err := commitWorkers(database, sid); err != nil {
+				return fmt.Errorf("cannot run command %s, error=%w", name, err)
+			}
+		}
+		switch name {
+		case WALCommandCheckpoint:
+			if argument == "" {
+				log.Error("Missing checkpoint label")
+				continue
+			}
+			err := saveCheckpoint(database, sid, argument, state.committedTransactionLSN, state.commitTime)
+			if err != nil {
+				log.Error("Cannot save checkpoint", "error", err)
+			}
+		case WALCommandResync:
+			if argument == "" {
+				log.Error("Missing resync table")
+				continue
+			}
+			resyncCommand(log, database, sid, argument, state.committedTransactionLSN)
+		case WALCommandPause:
+			pause = true
+		default:
+			log.Error("Unknown command")
+		}
+	}
+	if pause {
+		return errPause
+	}
+	return nil
+}
+
+// saveCheckpoint records a label with the source position committed in the destination.
+// A checkpoint received again after a restart is recorded only once.
+func saveCheckpoint(database, sid, label string, lsn pglogrepl.LSN, commitTime time.Time) error {
+	_, err := DestConnectionPool.Exec(context.Background(),
+		fmt.Sprintf(`INSERT INTO %s (database, sid, label, lsn, commit_time)
+		VALUES($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`, checkpointTableName()),
+		database, sid, label, lsn.String(), commitTime)
+	if err != nil {
+		return fmt.Errorf("cannot insert checkpoint, label=%s, error=%w", label, err)
+	}
+	return nil
+}
+
+// resyncCommand starts the resync of the clone destinations of a table from the source of the command.
+// The resync pauses the source, so it runs in the background and the destinations are resynced one
+// after the other. Destinations already resynced after the command are skipped when it is received again.
+func resyncCommand(log *slog.Logger, database, sid, table string, lsn pglogrepl.LSN) {
+	entries, err := MappingTable().FindAllByName(database, table)
+	if err != nil {
+		log.Error("Cannot resync unconfigured table", "error", err)
+		return
+	}
+	type job struct {
+		entry   MappingEntry
+		urls    []*SourceURL
+		allSIDs bool
+		status  ResyncStatus
+	}
+	jobs := make([]job, 0, len(entries))
+	for _, entry := range entries {
+		if fenced(operation{database: database, sid: sid, destTable: entry.destTable(), lsn: lsn}) {
+			log.Info("Skipping destination already resynced", "table", entry.destTable())
+			continue
+		}
+		urls, allSIDs, err := validateResync(entry, ResyncModeTruncate, sid)
+		if err != nil {
+			log.Error("Cannot resync table", "table", joinSchema(entry.Schema, entry.Name), "error", err)
+			continue
+		}
+		status := ResyncStatus{
+			ID:        entry.ID,
+			Table:     joinSchema(entry.Schema, entry.Name),
+			Mode:      ResyncModeTruncate,
+			SIDs:      []string{sid},
+			State:     ResyncStateRunning,
+			StartedAt: time.Now(),
+		}
+		if !startResyncJob(status) {
+			log.Warn("Resync already running", "table", status.Table)
+			continue
+		}
+		jobs = append(jobs, job{entry: entry, urls: urls, allSIDs: allSIDs, status: status})
+	}
+	go func() {
+		for _, j := range jobs {
+			err := resyncTable(log, j.entry, database, j.urls, ResyncModeTruncate, j.allSIDs)
+			if err != nil {
+				log.Error("Cannot resync table", "table", j.status.Table, "error", err)
+			}
+			finishResyncJob(j.entry.ID, err)
+		}
+	}()
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log/slog"
 	"strconv"
 	"sync"
@@ -29,6 +32,13 @@ type (
 		jobsCounter prometheus.Counter
 		tx          pgx.Tx
 		s           *sourceStatus
+		// operations received but not yet applied
+		pending []operation
+		// sources with operations in the current destination transaction
+		sources map[string]bool
+		// in transactional apply mode, set while a source transaction is applied with the error of its failed operation
+		atomic bool
+		failed error
 	}
 )
 
@@ -45,7 +55,20 @@ func (s *sourceStatus) Write(dbsid string, lsn pglogrepl.LSN) {
 	s.m[dbsid] = status
 }
 
-func (s *sourceStatus) Commit() {
+// Discard resets the written position of a source to its committed position, when the operations
+// of the source in the destination transaction are lost and will be received again.
+func (s *sourceStatus) Discard(dbsid string) {
+	s.Lock()
+	defer s.Unlock()
+	if status, ok := s.m[dbsid]; ok {
+		status.WrittenLSN = status.CommittedLSN
+		s.m[dbsid] = status
+	}
+}
+
+// Commit marks the written positions as committed. The sources with operations that are not
+// applied yet have their committed position set just before the first of these operations.
+func (s *sourceStatus) Commit(unapplied map[string]pglogrepl.LSN) {
 	s.Lock()
 	defer s.Unlock()
 	if s.m == nil {
@@ -54,6 +77,9 @@ func (s *sourceStatus) Commit() {
 	}
 	for k, v := range s.m {
 		v.CommittedLSN = v.WrittenLSN
+		if lsn, ok := unapplied[k]; ok && lsn > 0 && lsn <= v.WrittenLSN {
+			v.CommittedLSN = lsn - 1
+		}
 		s.m[k] = v
 	}
 }
@@ -62,22 +88,24 @@ func (w Worker) work() {
 	var op operation
 	var err error
 	log := w.log
+	w.sources = make(map[string]bool)
 	timer := time.NewTimer(time.Duration(config.App.CommitDelay) * time.Second)
 	for {
 		select {
 		case <-timer.C:
-			if w.tx == nil {
-				timer.Reset(time.Duration(config.App.CommitDelay) * time.Second)
-				continue
+			if w.flush() == nil {
+				_ = w.commit(nil)
 			}
-			if err = w.tx.Commit(context.Background()); err != nil {
-				log.Error("failed to commit transaction", "error", err)
-			}
-			w.s.Commit()
-			log.Debug("committed transaction", "lsn", w.s)
-			w.tx = nil
 			timer.Reset(time.Duration(config.App.CommitDelay) * time.Second)
 		case op = <-w.workChannel:
+			if op.opCode == "commit" {
+				if err = w.flush(); err != nil {
+					op.done <- err
+					continue
+				}
+				op.done <- w.commit(nil)
+				continue
+			}
 			w.jobsCounter.Inc()
 			if w.tx == nil {
 				w.tx, err = DestConnectionPool.Begin(context.Background())
@@ -87,27 +115,135 @@ func (w Worker) work() {
 				}
 			}
 			log.Debug("received operation", "op", op)
-			switch op.opCode {
-			case "ic":
-				_ = op.insertClone(w.tx)
-			case "uc":
-				_ = op.updateClone(w.tx)
-			case "dc":
-				_ = op.deleteClone(w.tx)
-			default:
-				log.Error("unhandled opcode", "op", op.opCode)
-			}
+			w.pending = append(w.pending, op)
+			w.sources[op.database+"-"+op.sid] = true
 			w.s.Write(op.database+"-"+op.sid, op.lsn)
-			log.Debug("Performed operation", "op", op, "lsn", w.s)
+			if len(w.pending) >= config.App.ApplyBatchSize {
+				_ = w.flush()
+			}
+			log.Debug("Buffered operation", "op", op, "lsn", w.s)
+		}
+	}
+}
+
+// commit commits the current destination transaction and marks the written positions as committed,
+// except for the unapplied operations of the sources.
+// When the commit fails, the positions stay uncommitted so that they are never confirmed to the
+// sources, and the sources with uncommitted changes are restarted to receive them again.
+func (w *Worker) commit(unapplied map[string]pglogrepl.LSN) error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit(context.Background())
+	w.tx = nil
+	if err != nil {
+		w.log.Error("failed to commit transaction, restarting sources", "error", err)
+		w.restartSources()
+		return fmt.Errorf("cannot commit destination transaction, error=%w", err)
+	}
+	clear(w.sources)
+	w.s.Commit(unapplied)
+	w.log.Debug("committed transaction", "lsn", w.s)
+	return nil
+}
+
+// abort rolls back the destination transaction when an operation could be neither applied nor moved
+// to the dead letter table. As with a failed commit, the positions stay uncommitted and the sources
+// with changes in the transaction are restarted to receive them again.
+func (w *Worker) abort(err error) {
+	w.log.Error("cannot apply operations, restarting sources", "error", err)
+	if w.tx != nil {
+		_ = w.tx.Rollback(context.Background())
+		w.tx = nil
+	}
+	w.restartSources()
+}
+
+// restartSources restarts the replication of the sources with changes in the failed transaction.
+// The commands are sent in the background as the replication may be waiting for this worker.
+func (w *Worker) restartSources() {
+	for dbsid := range w.sources {
+		delete(w.sources, dbsid)
+		w.s.Discard(dbsid)
+		url := findURLBySID(dbsid)
+		if url == nil {
+			w.log.Error("cannot find source to restart", "db-sid", dbsid)
+			continue
+		}
+		go func() {
+			if err := sendURLCommand(url, URLCommandRestart); err != nil {
+				w.log.Error("cannot restart source", "db-sid", dbsid, "error", err)
+			}
+		}()
+	}
+}
+
+// apply runs an operation in its own savepoint so that a failing operation does not abort
+// the destination transaction. Failed operations are moved to the dead letter table or, while
+// a source transaction is applied atomically, fail the whole source transaction.
+// It returns an error when the savepoint cannot be created, released or rolled back,
+// or the dead letter cannot be written.
+func (w *Worker) apply(op operation) error {
+	if w.failed != nil {
+		// the source transaction is rolled back anyway
+		return nil
+	}
+	ctx := context.Background()
+	savepoint, err := w.tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot create savepoint, table=%s, lsn=%s, error=%w", op.destTable, op.lsn, err)
+	}
+	err = op.execute(savepoint)
+	if err == nil || errors.Is(err, errNoAffectedRows) {
+		if err = savepoint.Commit(ctx); err != nil {
+			return fmt.Errorf("cannot release savepoint, table=%s, lsn=%s, error=%w", op.destTable, op.lsn, err)
 		}
+		return nil
+	}
+	if rbErr := savepoint.Rollback(ctx); rbErr != nil {
+		return fmt.Errorf("cannot rollback savepoint, table=%s, lsn=%s, error=%w", op.destTable, op.lsn, rbErr)
+	}
+	if w.atomic {
+		w.failed = fmt.Errorf("table=%s, op=%s, error=%w", op.destTable, op.opCode, err)
+		return nil
+	}
+	return op.deadLetter(w.tx, err)
+}
+
+// workerIndex selects the worker of an operation. Operations are sharded by table to keep
+// changes of a table in order. In transactional apply mode, complete source transactions are
+// sent instead and they are sharded by source to keep the transactions in order.
+func workerIndex(op operation) int {
+	if config.App.ApplyMode == ApplyModeTransactional {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(op.database + "-" + op.sid))
+		return int(h.Sum32() % uint32(len(Workers))) //nolint:gosec // number of workers is small
 	}
+	return int(op.id % int64(len(Workers)))
 }
 
 func SendWork(op operation) {
-	Workers[op.id%int64(len(Workers))].workChannel <- op
+	Workers[workerIndex(op)].workChannel <- op
+}
+
+// commitWorkers makes each worker commit its destination transaction. Workers process operations
+// in order, so when it returns without error all the operations sent before are committed in the destination.
+func commitWorkers(database, sid string) error {
+	var result error
+	for i := range Workers {
+		done := make(chan error)
+		Workers[i].workChannel <- operation{database: database, sid: sid, opCode: "commit", done: done}
+		if err := <-done; err != nil {
+			result = err
+		}
+	}
+	return result
 }
 
 func StartWorkers(numWorkers int) {
+	if config.App.ApplyBatchSize < 1 {
+		config.App.ApplyBatchSize = 1
+	}
 	Workers = make([]Worker, numWorkers)
 	for i := 0; i < numWorkers; i++ {
 		Workers[i].workChannel = make(chan operation)
@@ -119,6 +255,8 @@ func StartWorkers(numWorkers int) {
 	}
 }
 
+// SetCommittedLSN resets the positions of a source when its replication starts at a confirmed position.
+// Changes written after this position, including the ones lost by a failed commit, are received again.
 func SetCommittedLSN(database, sid string, lsn pglogrepl.LSN) {
 	dbsid := database + "-" + sid
 
@@ -128,10 +266,36 @@ func SetCommittedLSN(database, sid string, lsn pglogrepl.LSN) {
 
 		status := Workers[i].s.m[dbsid]
 		status.CommittedLSN = lsn
+		status.WrittenLSN = lsn
+		Workers[i].s.m[dbsid] = status
+	}
+}
+
+// SetConfirmedLSN records the position confirmed to the source.
+func SetConfirmedLSN(database, sid string, lsn pglogrepl.LSN) {
+	dbsid := database + "-" + sid
+
+	for i := range Workers {
+		Workers[i].s.Lock()
+		status := Workers[i].s.m[dbsid]
+		status.ConfirmedLSN = lsn
 		Workers[i].s.m[dbsid] = status
+		Workers[i].s.Unlock()
 	}
 }
 
+// GetSourceStatus returns the positions of a source tracked by each worker.
+func GetSourceStatus(database, sid string) []lsnStatus {
+	dbsid := database + "-" + sid
+	result := make([]lsnStatus, len(Workers))
+	for i := range Workers {
+		Workers[i].s.Lock()
+		result[i] = Workers[i].s.m[dbsid]
+		Workers[i].s.Unlock()
+	}
+	return result
+}
+
 func GetCommittedLSN(database, sid string, sourceCommittedLSN pglogrepl.LSN) pglogrepl.LSN {
 	dbsid := database + "-" + sid
 	// log := log.With("db-sid", dbsid)
@@ -161,5 +325,9 @@ func GetCommittedLSN(database, sid string, sourceCommittedLSN pglogrepl.LSN) pgl
 		}
 	}
 	// log.Debug("Found highest committed LSN", "highestCommittedLSN", highestCommittedLSN, "sourceCommittedLSN", sourceCommittedLSN)
+	// step 3 keep the changes held during a resync in the source until they are committed
+	if lsn := heldPosition(database, sid); lsn > 0 && highestCommittedLSN >= lsn {
+		highestCommittedLSN = lsn - 1
+	}
 	return highestCommittedLSN
 }
@@ -66,6 +66,29 @@ create table t7_0 partition of t7 for values from (0)to (19);
 create table t7_2 partition of t7 for values from (20) to (39);
 create table t8(sid text, id int, name text);
 create table pt8(sid text, id int, name text);
+create table t10(sid text, id int, payload text, primary key (sid, id));
+create table t11(sid text, id int, name text constraint t11_name_check check (name <> 'bad'), primary key (sid, id));
+create table t12(sid text, id int, name text);
+create table t13(sid text, id int, name text, kvsz_start timestamptz not null default '1900-01-01 00:00:00', primary key (sid, id));
+create table t13_history(sid text, id int, name text,
+    kvsz_start timestamptz not null default '1900-01-01 00:00:00',
+    kvsz_end timestamptz not null,
+    kvsz_deleted boolean not null default false);
+create table t14(kvsz_id bigserial, sid text, id int, name text,
+    kvsz_start timestamptz not null default '1900-01-01 00:00:00',
+    kvsz_end timestamptz not null default '9999-01-01 00:00:00',
+    is_current boolean not null default true,
+    version int not null default 1,
+    primary key(sid, id, kvsz_id));
+create table t15(sid text, id int, name text, kvsz_deleted boolean not null default false, primary key (sid, id));
+create table ev16(id bigserial primary key, sid text not null, source_table text not null, operation text not null,
+    before jsonb, after jsonb, lsn pg_lsn not null, xid bigint not null, commit_time timestamptz);
+create table t17(sid text, id int, name text, primary key (sid, id));
+create table t17_log(sid text, id int, name text);
+create table t18_eu(sid text, id int, region text, name text, primary key (sid, id));
+create table t18_us(sid text, id int, region text, name text, primary key (sid, id));
+create table t19(sid text, id int, full_name text, password text, salary int, region text, primary key (sid, id));
+create table t20(sid text, id int, name text, primary key (sid, id));
 
 -- Without sid
 create table d0(id bigint, ts timestamptz, name text);
@@ -82,6 +82,20 @@ create table d7_3 partition of d7 for values from (30) to (39);
 create table private.d8(id serial primary key, name text);
 create table public.d8(id serial primary key, name text);
 
+create table t10(id int primary key, payload text);
+create table t11(id serial primary key, name text);
+create table t12(id int primary key, name text);
+insert into t12 select g, 'row ' || g from generate_series(1, 1000) g;
+create table t13(id serial primary key, name text);
+create table t14(id serial primary key, name text);
+create table t15(id serial primary key, name text);
+create table t16(id serial primary key, name text);
+alter table t16 replica identity full;
+create table t17(id serial primary key, name text);
+create table t18(id serial primary key, region text, name text);
+alter table t18 replica identity full;
+create table t19(id serial primary key, name text, password text, salary int);
+create table t20(id serial primary key, name text);
 
 create database db2;
 \c db2